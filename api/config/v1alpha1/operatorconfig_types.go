@@ -0,0 +1,188 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+)
+
+// NotebookConfig holds the settings of the Jupyter controller
+type NotebookConfig struct {
+	// DefaultImage is used for notebook containers that don't set an image
+	DefaultImage string `json:"defaultImage,omitempty"`
+
+	// CullIdleTime stops notebooks whose server has been idle for that long.
+	// Culling is disabled when unset.
+	CullIdleTime *metav1.Duration `json:"cullIdleTime,omitempty"`
+
+	// DisruptionGracePeriod is how long the user of a running notebook is
+	// warned before it is culled, stopped by its schedule or restarted for a
+	// spec change. These are taken at once when unset.
+	DisruptionGracePeriod *metav1.Duration `json:"disruptionGracePeriod,omitempty"`
+
+	// MaxConcurrentReconciles is the number of notebooks reconciled in parallel
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+
+	// DefaultResources is used for notebook containers that don't set requests or limits
+	DefaultResources corev1.ResourceRequirements `json:"defaultResources,omitempty"`
+
+	// NetworkPolicy configures the NetworkPolicies of isolated notebooks
+	NetworkPolicy NetworkPolicyConfig `json:"networkPolicy,omitempty"`
+
+	// Profiles are named pod templates notebook runs can execute in
+	Profiles map[string]corev1.PodSpec `json:"profiles,omitempty"`
+
+	// GitImage clones the repository of notebook runs reading from git, it
+	// needs git and sh. Pin it to a tag or digest. Runs reading from git
+	// fail when unset.
+	GitImage string `json:"gitImage,omitempty"`
+
+	// ServiceAccountClusterRoles are the ClusterRoles notebooks may bind to
+	// their ServiceAccount, spec.serviceAccount is refused when empty. The
+	// operator can only bind the ClusterRoles its own role grants bind on,
+	// config/rbac grants view and edit: listing another role requires adding
+	// it to the resourceNames of the clusterroles bind rule of the manager
+	// role, otherwise the notebooks asking for it are refused.
+	ServiceAccountClusterRoles []string `json:"serviceAccountClusterRoles,omitempty"`
+}
+
+// AllowsClusterRole reports whether notebooks may bind name to their ServiceAccount
+func (c NotebookConfig) AllowsClusterRole(name string) bool {
+	for _, role := range c.ServiceAccountClusterRoles {
+		if role == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NetworkPolicyConfig holds the admin-configured peers of isolated notebooks
+type NetworkPolicyConfig struct {
+	// IngressNamespaceSelector selects the namespaces, e.g. the ingress
+	// controller's, allowed to reach the notebook.
+	IngressNamespaceSelector *metav1.LabelSelector `json:"ingressNamespaceSelector,omitempty"`
+
+	// AuthProxySelector selects the auth proxy pods, in any namespace,
+	// allowed to reach the notebook.
+	AuthProxySelector *metav1.LabelSelector `json:"authProxySelector,omitempty"`
+
+	// EgressCIDRs lists the extra destinations the notebook may reach.
+	EgressCIDRs []string `json:"egressCIDRs,omitempty"`
+
+	// OperatorPeer selects the operator pods, which call the notebook
+	// servers. Defaults to the control-plane=controller-manager pods of the
+	// namespaces with that label, as deployed by config/default.
+	OperatorPeer *networkingv1.NetworkPolicyPeer `json:"operatorPeer,omitempty"`
+}
+
+// DaskConfig holds the settings of the Dask controller
+type DaskConfig struct {
+	// MaxConcurrentReconciles is the number of Dask clusters reconciled in parallel
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+
+	// DefaultResources is used for scheduler and worker containers that don't set requests or limits
+	DefaultResources corev1.ResourceRequirements `json:"defaultResources,omitempty"`
+
+	// DashboardIngress exposes the scheduler dashboards, which are only
+	// reachable in-cluster when unset.
+	DashboardIngress *DashboardIngressConfig `json:"dashboardIngress,omitempty"`
+}
+
+// DashboardIngressConfig exposes each scheduler dashboard through an Ingress
+// at /dask/<namespace>/<name>
+type DashboardIngressConfig struct {
+	// Host is the host the dashboards are served on
+	Host string `json:"host"`
+
+	// IngressClassName selects the ingress controller
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+
+	// Annotations are added to the Ingresses, e.g. to put an auth proxy in front
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// TLSSecretName names the Secret, in each namespace, holding the
+	// certificate of Host. The dashboards are served over plain HTTP when unset.
+	TLSSecretName string `json:"tlsSecretName,omitempty"`
+}
+
+// QuotaScope is what the caps of a quota apply to
+type QuotaScope string
+
+const (
+	// QuotaScopeNamespace caps the objects of each namespace
+	QuotaScopeNamespace QuotaScope = "Namespace"
+	// QuotaScopeOwner caps the objects of each creator, across namespaces
+	QuotaScopeOwner QuotaScope = "Owner"
+)
+
+// QuotaConfig caps what the notebooks and Dask clusters of a namespace, or of
+// a user, may use, rejecting the objects that would exceed it. A zero cap is
+// unlimited.
+type QuotaConfig struct {
+	// Scope is what the caps apply to, Namespace by default
+	Scope QuotaScope `json:"scope,omitempty"`
+
+	// MaxRunningNotebooks is the number of notebooks that aren't stopped
+	MaxRunningNotebooks int `json:"maxRunningNotebooks,omitempty"`
+
+	// MaxDaskWorkers is the total number of workers of the Dask clusters
+	MaxDaskWorkers int32 `json:"maxDaskWorkers,omitempty"`
+
+	// MaxCPU is the total CPU requested by the notebook, scheduler and worker templates
+	MaxCPU *resource.Quantity `json:"maxCPU,omitempty"`
+
+	// MaxMemory is the total memory requested by the notebook, scheduler and worker templates
+	MaxMemory *resource.Quantity `json:"maxMemory,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// OperatorConfig is the Schema for the operator configuration file
+type OperatorConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ControllerManagerConfigurationSpec returns the configurations for controllers
+	cfg.ControllerManagerConfigurationSpec `json:",inline"`
+
+	// Namespaces restricts the operator to these namespaces. All namespaces
+	// are watched when both Namespaces and NamespaceSelector are empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// NamespaceSelector adds the namespaces matching it to Namespaces. It is
+	// resolved at startup, so newly labelled namespaces need a restart.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	Notebook NotebookConfig `json:"notebook,omitempty"`
+
+	Dask DaskConfig `json:"dask,omitempty"`
+
+	// Quota is enforced by the admission webhook
+	Quota QuotaConfig `json:"quota,omitempty"`
+}
+
+// Complete returns the manager settings of the configuration
+func (c *OperatorConfig) Complete() (cfg.ControllerManagerConfigurationSpec, error) {
+	return c.ControllerManagerConfigurationSpec, nil
+}
+
+func init() {
+	SchemeBuilder.Register(&OperatorConfig{})
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"encoding/json"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// v2SpecAnnotation keeps the v2 fields a v1 Jupyter can't hold, so that a
+// round trip through v1 doesn't lose them.
+const v2SpecAnnotation = "operators.convect.ai/v2-spec"
+
+// v2StatusAnnotation does the same for the status.
+const v2StatusAnnotation = "operators.convect.ai/v2-status"
+
+// ConvertTo converts this Jupyter to the Hub version (v2).
+func (src *Jupyter) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*operatorsv2.Jupyter)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	if spec, ok := dst.Annotations[v2SpecAnnotation]; ok {
+		if err := json.Unmarshal([]byte(spec), &dst.Spec); err != nil {
+			return err
+		}
+		delete(dst.Annotations, v2SpecAnnotation)
+	}
+	if status, ok := dst.Annotations[v2StatusAnnotation]; ok {
+		if err := json.Unmarshal([]byte(status), &dst.Status); err != nil {
+			return err
+		}
+		delete(dst.Annotations, v2StatusAnnotation)
+	}
+	if len(dst.Annotations) == 0 {
+		dst.Annotations = nil
+	}
+
+	dst.Spec.Template.Spec = *src.Spec.Template.Spec.DeepCopy()
+	dst.Status.ReadyReplicas = src.Status.ReadyReplicas
+	dst.Status.ContainerState = *src.Status.ContainerState.DeepCopy()
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v2) to this version.
+func (dst *Jupyter) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*operatorsv2.Jupyter)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Spec.Template.Spec = *src.Spec.Template.Spec.DeepCopy()
+	dst.Status.ReadyReplicas = src.Status.ReadyReplicas
+	dst.Status.ContainerState = *src.Status.ContainerState.DeepCopy()
+
+	rest := src.Spec.DeepCopy()
+	rest.Template.Spec = corev1.PodSpec{}
+	if err := stash(dst, v2SpecAnnotation, rest, &operatorsv2.JupyterSpec{}); err != nil {
+		return err
+	}
+
+	status := src.Status.DeepCopy()
+	status.ReadyReplicas = 0
+	status.ContainerState = corev1.ContainerState{}
+	return stash(dst, v2StatusAnnotation, status, &operatorsv2.JupyterStatus{})
+}
+
+// stash keeps v in an annotation of dst, unless it equals empty.
+func stash(dst *Jupyter, annotation string, v, empty interface{}) error {
+	if reflect.DeepEqual(v, empty) {
+		return nil
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if dst.Annotations == nil {
+		dst.Annotations = map[string]string{}
+	}
+	dst.Annotations[annotation] = string(value)
+	return nil
+}
@@ -0,0 +1,72 @@
+package v1
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var podSpec = corev1.PodSpec{Containers: []corev1.Container{{Name: "notebook", Image: "jupyter/minimal-notebook"}}}
+
+func TestConvertTo(t *testing.T) {
+	old := &Jupyter{
+		ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "default"},
+		Spec:       JupyterSpec{Template: JupyterTemplate{Spec: podSpec}},
+		Status:     JupyterStatus{ReadyReplicas: 1},
+	}
+
+	hub := &operatorsv2.Jupyter{}
+	if err := old.ConvertTo(hub); err != nil {
+		t.Fatal(err)
+	}
+	if hub.Name != "legacy" || !reflect.DeepEqual(hub.Spec.Template.Spec, podSpec) || hub.Status.ReadyReplicas != 1 {
+		t.Errorf("ConvertTo() = %+v", hub)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	lastActivity := metav1.Date(2021, 6, 2, 10, 0, 0, 0, time.UTC)
+	hub := &operatorsv2.Jupyter{
+		ObjectMeta: metav1.ObjectMeta{Name: "current", Namespace: "default"},
+		Spec: operatorsv2.JupyterSpec{
+			Template:  operatorsv2.JupyterTemplate{Spec: podSpec},
+			Isolation: true,
+			DaskRef:   &corev1.LocalObjectReference{Name: "cluster"},
+		},
+		Status: operatorsv2.JupyterStatus{
+			ReadyReplicas: 1,
+			Phase:         operatorsv2.JupyterRunning,
+			URL:           "http://current.default.svc",
+			Image:         "jupyter/minimal-notebook",
+			LastActivity:  &lastActivity,
+		},
+	}
+
+	old := &Jupyter{}
+	if err := old.ConvertFrom(hub); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(old.Spec.Template.Spec, podSpec) || old.Status.ReadyReplicas != 1 {
+		t.Errorf("ConvertFrom() = %+v", old)
+	}
+
+	back := &operatorsv2.Jupyter{}
+	if err := old.ConvertTo(back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back.Spec, hub.Spec) {
+		t.Errorf("spec after a round trip = %+v, want %+v", back.Spec, hub.Spec)
+	}
+	if !equality.Semantic.DeepEqual(back.Status, hub.Status) {
+		t.Errorf("status after a round trip = %+v, want %+v", back.Status, hub.Status)
+	}
+	if len(back.Annotations) != 0 {
+		t.Errorf("annotations after a round trip = %v, want none", back.Annotations)
+	}
+}
@@ -19,6 +19,7 @@ package v2
 import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -26,25 +27,151 @@ import (
 
 // DaskSpec defines the desired state of Dask
 type DaskSpec struct {
-	NumWorkers        *int32         `json:"numWorkers"`
+	// NumWorkers is the number of workers of the default group, 1 when unset.
+	// +optional
+	NumWorkers        *int32         `json:"numWorkers,omitempty"`
 	SchedulerTemplate WorkerTemplate `json:"schedulerTemplate"`
-	WorkerTemplate    WorkerTemplate `json:"workerTemplate"`
+
+	// WorkerTemplate is the pod template of the default group.
+	// +optional
+	WorkerTemplate WorkerTemplate `json:"workerTemplate,omitempty"`
+
+	// WorkerGroups replace the default group of NumWorkers workers with
+	// several groups, e.g. for tasks that only fit on big-memory nodes.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	WorkerGroups []DaskWorkerGroup `json:"workerGroups,omitempty"`
+
+	// IdleTimeout tears the cluster down once no client has been connected
+	// and no task has run for that long. Clusters never idle out when unset.
+	// +optional
+	IdleTimeout *metav1.Duration `json:"idleTimeout,omitempty"`
+
+	// IdlePolicy is how an idle cluster is torn down, ScaleToZero by default.
+	// +optional
+	IdlePolicy DaskIdlePolicy `json:"idlePolicy,omitempty"`
+
+	// TLS encrypts and authenticates the traffic between the scheduler, the
+	// workers and the clients with certificates of a per-cluster CA. The
+	// notebooks referencing the cluster get the client certificate.
+	// +optional
+	TLS bool `json:"tls,omitempty"`
+
+	// WorkerMinAvailable is the number or percentage of the workers of each
+	// group node drains must leave running. Workers may all be evicted when
+	// unset, the scheduler never is.
+	// +optional
+	WorkerMinAvailable *intstr.IntOrString `json:"workerMinAvailable,omitempty"`
 }
 
+// DaskIdlePolicy is how a Dask cluster past its idle timeout is torn down
+// +kubebuilder:validation:Enum=ScaleToZero;Delete
+type DaskIdlePolicy string
+
+const (
+	// IdleScaleToZero stops the workers, annotating the cluster as stopped.
+	// Removing the annotation brings the workers back.
+	IdleScaleToZero DaskIdlePolicy = "ScaleToZero"
+	// IdleDelete deletes the cluster
+	IdleDelete DaskIdlePolicy = "Delete"
+)
+
 type WorkerTemplate struct {
 	Spec corev1.PodSpec `json:"spec,omitempty"`
 }
 
+// DaskWorkerGroup is a set of identical workers of a Dask cluster
+type DaskWorkerGroup struct {
+	// Name tells the group apart, e.g. highmem or spot.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=30
+	Name string `json:"name"`
+
+	// Replicas is the number of workers of the group, 1 when unset.
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	Template WorkerTemplate `json:"template"`
+
+	// Resources are the abstract resources each worker advertises to the
+	// scheduler, e.g. {"highmem": "1"}, so that the tasks annotated with
+	// them only run on the group. They are passed as dask-worker --resources
+	// unless the template sets its own command.
+	// +optional
+	Resources map[string]string `json:"resources,omitempty"`
+}
+
+// DaskWorkerGroupStatus is the observed state of a worker group
+type DaskWorkerGroupStatus struct {
+	Name          string `json:"name"`
+	Replicas      int32  `json:"replicas"`
+	ReadyReplicas int32  `json:"readyReplicas"`
+}
+
+// EffectiveWorkerGroups returns the worker groups of the cluster, a single
+// unnamed group of NumWorkers workers when it doesn't list any.
+func (d *Dask) EffectiveWorkerGroups() []DaskWorkerGroup {
+	if len(d.Spec.WorkerGroups) > 0 {
+		return d.Spec.WorkerGroups
+	}
+	return []DaskWorkerGroup{{
+		Replicas: d.Spec.NumWorkers,
+		Template: d.Spec.WorkerTemplate,
+	}}
+}
+
 // DaskStatus defines the observed state of Dask
 type DaskStatus struct {
 	SchedulerReadyReplicas int32 `json:"schedulerReady"`
 	WorkerReadyReplicas    int32 `json:"workerReady"`
 	DesiredWorkers         int32 `json:"desiredWorkers"`
+
+	// WorkerGroups reports the readiness of each of spec.workerGroups.
+	// +optional
+	WorkerGroups []DaskWorkerGroupStatus `json:"workerGroups,omitempty"`
+
+	// RestartedAt is the last restartedAt annotation value the pods were restarted for.
+	// +optional
+	RestartedAt string `json:"restartedAt,omitempty"`
+
+	// DashboardURL is the address of the scheduler dashboard, through the
+	// Ingress when the operator exposes the dashboards.
+	// +optional
+	DashboardURL string `json:"dashboardURL,omitempty"`
+
+	// SchedulerAddress is the in-cluster address clients connect to.
+	// +optional
+	SchedulerAddress string `json:"schedulerAddress,omitempty"`
+
+	// ClientSecretName is the Secret holding the client certificate and the
+	// Dask configuration to connect to a TLS cluster, mounted at /etc/dask.
+	// +optional
+	ClientSecretName string `json:"clientSecretName,omitempty"`
+
+	// Creator is the user who created the cluster.
+	// +optional
+	Creator string `json:"creator,omitempty"`
+
+	// IdleSince is when the scheduler was first seen without clients nor
+	// running tasks, unset while the cluster is in use.
+	// +optional
+	IdleSince *metav1.Time `json:"idleSince,omitempty"`
+
+	// Reason explains why the workers were scaled to zero, or why the
+	// cluster isn't running as its spec asks.
+	// +optional
+	Reason string `json:"reason,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
-//+kubebuilder:resource:path=dasks,singular=dask,scope=Namespaced
+//+kubebuilder:resource:path=dasks,singular=dask,scope=Namespaced,shortName=dk,categories=notebooks
+//+kubebuilder:printcolumn:name="Scheduler",type=integer,JSONPath=`.status.schedulerReady`,description="Ready scheduler replicas"
+//+kubebuilder:printcolumn:name="Workers",type=integer,JSONPath=`.status.workerReady`,description="Ready workers"
+//+kubebuilder:printcolumn:name="Desired",type=integer,JSONPath=`.status.desiredWorkers`,description="Desired workers"
+//+kubebuilder:printcolumn:name="Dashboard",type=string,JSONPath=`.status.dashboardURL`,description="Scheduler dashboard URL"
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Dask is the Schema for the dasks API
 type Dask struct {
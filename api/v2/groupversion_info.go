@@ -34,3 +34,21 @@ var (
 	// AddToScheme adds the types in this group-version to the given scheme.
 	AddToScheme = SchemeBuilder.AddToScheme
 )
+
+const (
+	// RestartedAtAnnotation restarts the pods of a Jupyter or Dask whenever its value changes
+	RestartedAtAnnotation = "operators.convect.ai/restartedAt"
+
+	// StoppedAnnotation stops a Jupyter, or the workers of a Dask, while it is
+	// set. Its value records when it was stopped.
+	StoppedAnnotation = "operators.convect.ai/stopped"
+
+	// CreatorAnnotation records the user who created a Jupyter or Dask, it is set by the admission webhook
+	CreatorAnnotation = "operators.convect.ai/creator"
+
+	// SnapshotAnnotation stops a Jupyter while the NotebookSnapshot it names is taken
+	SnapshotAnnotation = "operators.convect.ai/snapshot"
+
+	// ScheduledAtAnnotation records when the run of a ScheduledNotebookRun was due
+	ScheduledAtAnnotation = "operators.convect.ai/scheduledAt"
+)
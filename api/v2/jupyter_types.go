@@ -18,6 +18,7 @@ package v2
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -27,21 +28,245 @@ import (
 // JupyterSpec defines the desired state of Jupyter
 type JupyterSpec struct {
 	Template JupyterTemplate `json:"template,omitempty"`
+
+	// Isolation makes the controller own a NetworkPolicy that only lets the
+	// notebook talk to the ingress controller, DNS and its Dask scheduler.
+	// +optional
+	Isolation bool `json:"isolation,omitempty"`
+
+	// DaskRef names the Dask cluster in the same namespace used by the notebook.
+	// +optional
+	DaskRef *corev1.LocalObjectReference `json:"daskRef,omitempty"`
+
+	// ServiceAccount makes the controller provision a dedicated ServiceAccount
+	// for the notebook pod.
+	// +optional
+	ServiceAccount *NotebookServiceAccount `json:"serviceAccount,omitempty"`
+
+	// Schedule stops and starts the notebook at fixed times, regardless of
+	// its activity.
+	// +optional
+	Schedule *NotebookSchedule `json:"schedule,omitempty"`
+
+	// Workspace makes the controller own a PersistentVolumeClaim mounted as
+	// the notebook home, kept while the notebook is stopped. Deleting the
+	// notebook deletes the claim, and its data, unless its reclaim policy
+	// is Retain.
+	// +optional
+	Workspace *NotebookWorkspace `json:"workspace,omitempty"`
+
+	// NotebookImage names the NotebookImage the notebook container runs,
+	// instead of the image of the template.
+	// +optional
+	NotebookImage string `json:"notebookImage,omitempty"`
+
+	// UpdatePolicy is when a change of the template, or of the NotebookImage,
+	// restarts a running notebook.
+	// +kubebuilder:default=Immediate
+	// +optional
+	UpdatePolicy UpdatePolicy `json:"updatePolicy,omitempty"`
 }
 
+// UpdatePolicy is when a change of the template of a running notebook is applied
+// +kubebuilder:validation:Enum=Immediate;OnIdle;OnNextStart
+type UpdatePolicy string
+
+const (
+	// UpdateImmediate restarts the notebook at once, after the disruption
+	// grace period if one is configured
+	UpdateImmediate UpdatePolicy = "Immediate"
+	// UpdateOnIdle restarts the notebook once its server has no connection
+	// nor running kernel
+	UpdateOnIdle UpdatePolicy = "OnIdle"
+	// UpdateOnNextStart applies the change once the notebook is stopped
+	UpdateOnNextStart UpdatePolicy = "OnNextStart"
+)
+
 type JupyterTemplate struct {
+	// Metadata is added to the notebook pod, e.g. sidecar injection or
+	// Prometheus scrape annotations.
+	// +optional
+	Metadata TemplateMetadata `json:"metadata,omitempty"`
+
 	Spec corev1.PodSpec `json:"spec,omitempty"`
 }
 
+// TemplateMetadata is the subset of metadata that can be set on generated pods
+type TemplateMetadata struct {
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// NotebookServiceAccount describes the ServiceAccount owned by a notebook
+type NotebookServiceAccount struct {
+	// ClusterRole is bound to the ServiceAccount within the notebook's
+	// namespace. It must be allowed by the operator configuration.
+	// +kubebuilder:validation:MinLength=1
+	ClusterRole string `json:"clusterRole"`
+}
+
+// NotebookWorkspace describes the persistent workspace of a notebook
+type NotebookWorkspace struct {
+	// Size is the requested capacity of the workspace.
+	Size resource.Quantity `json:"size"`
+
+	// StorageClassName is the storage class of the workspace, the cluster
+	// default when unset. It must have a CSI driver to take snapshots.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// MountPath is where the workspace is mounted, /home/jovyan by default.
+	// +optional
+	MountPath string `json:"mountPath,omitempty"`
+
+	// FromSnapshot names a NotebookSnapshot, in the same namespace, the
+	// workspace is restored from when it is created.
+	// +optional
+	FromSnapshot string `json:"fromSnapshot,omitempty"`
+
+	// ReclaimPolicy is what happens to the claim when the notebook is deleted.
+	// +kubebuilder:default=Delete
+	// +optional
+	ReclaimPolicy WorkspaceReclaimPolicy `json:"reclaimPolicy,omitempty"`
+}
+
+// WorkspaceReclaimPolicy is what happens to a workspace when its notebook is deleted
+// +kubebuilder:validation:Enum=Delete;Retain
+type WorkspaceReclaimPolicy string
+
+const (
+	// WorkspaceDelete garbage-collects the claim along with the notebook
+	WorkspaceDelete WorkspaceReclaimPolicy = "Delete"
+	// WorkspaceRetain keeps the claim, a notebook created again with the
+	// same name mounts it
+	WorkspaceRetain WorkspaceReclaimPolicy = "Retain"
+)
+
+// NotebookSchedule describes the times at which a notebook is stopped and started
+type NotebookSchedule struct {
+	// Stop is the cron expression at which the notebook is stopped, e.g. "0 20 * * 1-5".
+	// +kubebuilder:validation:MinLength=1
+	Stop string `json:"stop"`
+
+	// Start is the cron expression at which the notebook is started, e.g. "0 8 * * 1-5".
+	// +kubebuilder:validation:MinLength=1
+	Start string `json:"start"`
+
+	// TimeZone is the IANA time zone the expressions are evaluated in. Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// JupyterPhase is a simple, high-level summary of where the notebook is in its lifecycle
+type JupyterPhase string
+
+const (
+	// JupyterPending means the notebook should run but its pod is not ready yet
+	JupyterPending JupyterPhase = "Pending"
+	// JupyterRunning means the notebook pod is ready
+	JupyterRunning JupyterPhase = "Running"
+	// JupyterStopped means the notebook has been scaled down
+	JupyterStopped JupyterPhase = "Stopped"
+)
+
 // JupyterStatus defines the observed state of Jupyter
 type JupyterStatus struct {
 	ReadyReplicas  int32                 `json:"readyReplicas"`
 	ContainerState corev1.ContainerState `json:"containerState"`
+
+	// +optional
+	Phase JupyterPhase `json:"phase,omitempty"`
+
+	// RestartedAt is the last restartedAt annotation value the pods were restarted for.
+	// +optional
+	RestartedAt string `json:"restartedAt,omitempty"`
+
+	// URL is the in-cluster address of the notebook server.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Creator is the user who created the notebook.
+	// +optional
+	Creator string `json:"creator,omitempty"`
+
+	// LastActivity is the last activity reported by the notebook server.
+	// +optional
+	LastActivity *metav1.Time `json:"lastActivity,omitempty"`
+
+	// PendingAction is the disruption the user was warned about, it is taken
+	// once its grace period is over.
+	// +optional
+	PendingAction *PendingAction `json:"pendingAction,omitempty"`
+
+	// Image is the image the notebook pod runs.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// PendingTemplateHash is the hash of the template held back by the
+	// update policy, the running pod doesn't have it yet.
+	// +optional
+	PendingTemplateHash string `json:"pendingTemplateHash,omitempty"`
+
+	// PendingImage is the image of the template held back, when it changes
+	// the image of the notebook pod.
+	// +optional
+	PendingImage string `json:"pendingImage,omitempty"`
+
+	// DeprecatedImage names the deprecated NotebookImage the notebook runs,
+	// its user was warned about.
+	// +optional
+	DeprecatedImage string `json:"deprecatedImage,omitempty"`
+
+	// Reason explains why the notebook isn't running as its spec asks.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+// NotebookAction is a disruption of a running notebook the user didn't ask for
+// +kubebuilder:validation:Enum=Cull;Stop;Restart
+type NotebookAction string
+
+const (
+	// ActionCull stops a notebook whose server has been idle for too long
+	ActionCull NotebookAction = "Cull"
+	// ActionStop stops a notebook outside of its schedule
+	ActionStop NotebookAction = "Stop"
+	// ActionRestart restarts a notebook to apply a change of its spec
+	ActionRestart NotebookAction = "Restart"
+)
+
+// PendingAction is a disruption announced to the user of a notebook
+type PendingAction struct {
+	Action NotebookAction `json:"action"`
+
+	// NotBefore is when the grace period of the action is over
+	NotBefore metav1.Time `json:"notBefore"`
+
+	// Notified is set once the notebook server shows the warning. It is
+	// retried until then, the event being the only warning meanwhile.
+	// +optional
+	Notified bool `json:"notified,omitempty"`
+
+	// NoticeActivity is the last activity of the server once it shows the
+	// warning. Writing the warning is activity too, the activity up to it
+	// isn't the user's and doesn't keep the notebook from being culled.
+	// +optional
+	NoticeActivity *metav1.Time `json:"noticeActivity,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
-//+kubebuilder:resource:path=jupyters,singular=jupyter,scope=Namespaced
+//+kubebuilder:storageversion
+//+kubebuilder:resource:path=jupyters,singular=jupyter,scope=Namespaced,shortName=nb,categories=notebooks
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`,description="Notebook phase"
+//+kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyReplicas`,description="Ready replicas"
+//+kubebuilder:printcolumn:name="Image",type=string,JSONPath=`.status.image`,description="Notebook image"
+//+kubebuilder:printcolumn:name="Pending",type=string,JSONPath=`.status.pendingImage`,description="Image applied on the next restart",priority=1
+//+kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.status.url`,description="Notebook server URL"
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Jupyter is the Schema for the jupyters API
 type Jupyter struct {
@@ -0,0 +1,86 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NotebookImageSpec defines the desired state of NotebookImage
+type NotebookImageSpec struct {
+	// Image is the reference the notebooks run. Pin it by digest so that
+	// upgrading the notebooks is a change of the catalog entry.
+	// +kubebuilder:validation:MinLength=1
+	Image string `json:"image"`
+
+	// Description tells users what the image provides.
+	// +optional
+	Description string `json:"description,omitempty"`
+
+	// Default makes notebooks that set neither an image nor a catalog entry
+	// run this image.
+	// +optional
+	Default bool `json:"default,omitempty"`
+
+	// Deprecated warns the owners of the notebooks still using the image.
+	// +optional
+	Deprecated bool `json:"deprecated,omitempty"`
+}
+
+// NotebookImageStatus defines the observed state of NotebookImage. It is
+// reported by the operator watching all namespaces, if any.
+type NotebookImageStatus struct {
+	// Notebooks is the number of notebooks using the image.
+	// +optional
+	Notebooks int32 `json:"notebooks,omitempty"`
+
+	// OutdatedNotebooks lists the notebooks, as namespace/name, whose pod
+	// doesn't run the image yet.
+	// +optional
+	OutdatedNotebooks []string `json:"outdatedNotebooks,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:path=notebookimages,singular=notebookimage,scope=Cluster,shortName=nbi,categories=notebooks
+//+kubebuilder:printcolumn:name="Image",type=string,JSONPath=`.spec.image`,description="Image reference"
+//+kubebuilder:printcolumn:name="Default",type=boolean,JSONPath=`.spec.default`,description="Used by notebooks without an image"
+//+kubebuilder:printcolumn:name="Deprecated",type=boolean,JSONPath=`.spec.deprecated`,description="Deprecated image"
+//+kubebuilder:printcolumn:name="Notebooks",type=integer,JSONPath=`.status.notebooks`,description="Notebooks using the image"
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// NotebookImage is a catalog entry naming an image notebooks can run
+type NotebookImage struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NotebookImageSpec   `json:"spec,omitempty"`
+	Status NotebookImageStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// NotebookImageList contains a list of NotebookImage
+type NotebookImageList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NotebookImage `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NotebookImage{}, &NotebookImageList{})
+}
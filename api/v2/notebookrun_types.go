@@ -0,0 +1,149 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NotebookRunSpec defines the desired state of NotebookRun
+type NotebookRunSpec struct {
+	// Notebook is the path of the .ipynb to execute, relative to the source.
+	// +kubebuilder:validation:MinLength=1
+	Notebook string `json:"notebook"`
+
+	// Output is where the executed notebook is written, relative to the
+	// source, or any URL papermill supports such as s3://. Defaults to the
+	// notebook path with a -output suffix.
+	// +optional
+	Output string `json:"output,omitempty"`
+
+	// Parameters are injected into the parameters cell of the notebook.
+	// +optional
+	Parameters map[string]string `json:"parameters,omitempty"`
+
+	Source NotebookRunSource `json:"source"`
+
+	Environment NotebookRunEnvironment `json:"environment"`
+
+	// BackoffLimit is the number of retries of a failed run, none by default.
+	// +optional
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+
+	// ActiveDeadlineSeconds bounds the duration of the run.
+	// +optional
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+}
+
+// NotebookRunSource is where the notebook is read from, exactly one field is set
+type NotebookRunSource struct {
+	// Workspace names the Jupyter whose workspace holds the notebook. The
+	// workspace is mounted read-write, so the output is stored back to it.
+	// +optional
+	Workspace string `json:"workspace,omitempty"`
+
+	// Git clones the notebook from a repository.
+	// +optional
+	Git *GitSource `json:"git,omitempty"`
+}
+
+// GitSource is a git repository holding notebooks
+type GitSource struct {
+	// +kubebuilder:validation:MinLength=1
+	Repository string `json:"repository"`
+
+	// Revision is the branch, tag or commit to check out, the default branch when unset.
+	// +optional
+	Revision string `json:"revision,omitempty"`
+}
+
+// NotebookRunEnvironment is the pod the notebook runs in, exactly one field
+// is set. Its first container must have papermill installed.
+type NotebookRunEnvironment struct {
+	// Jupyter names the notebook whose pod template is reused, so that the
+	// run has the same image, resources and env as the interactive notebook.
+	// +optional
+	Jupyter string `json:"jupyter,omitempty"`
+
+	// Profile names a pod template of the operator configuration.
+	// +optional
+	Profile string `json:"profile,omitempty"`
+}
+
+// NotebookRunPhase is the progress of a NotebookRun
+type NotebookRunPhase string
+
+const (
+	// RunPending means the Job pod hasn't started yet
+	RunPending NotebookRunPhase = "Pending"
+	// RunRunning means the notebook is being executed
+	RunRunning NotebookRunPhase = "Running"
+	// RunSucceeded means the notebook ran to completion
+	RunSucceeded NotebookRunPhase = "Succeeded"
+	// RunFailed means the notebook failed, see the reason
+	RunFailed NotebookRunPhase = "Failed"
+)
+
+// NotebookRunStatus defines the observed state of NotebookRun
+type NotebookRunStatus struct {
+	// +optional
+	Phase NotebookRunPhase `json:"phase,omitempty"`
+
+	// JobName is the Job executing the notebook.
+	// +optional
+	JobName string `json:"jobName,omitempty"`
+
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Reason explains why the run failed, or why it is waiting to start.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:path=notebookruns,singular=notebookrun,scope=Namespaced,shortName=nbr,categories=notebooks
+//+kubebuilder:printcolumn:name="Notebook",type=string,JSONPath=`.spec.notebook`,description="Executed notebook"
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`,description="Run phase"
+//+kubebuilder:printcolumn:name="Started",type=date,JSONPath=`.status.startTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// NotebookRun is the Schema for the notebookruns API
+type NotebookRun struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NotebookRunSpec   `json:"spec,omitempty"`
+	Status NotebookRunStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// NotebookRunList contains a list of NotebookRun
+type NotebookRunList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NotebookRun `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NotebookRun{}, &NotebookRunList{})
+}
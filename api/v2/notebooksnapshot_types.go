@@ -0,0 +1,99 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NotebookSnapshotSpec defines the desired state of NotebookSnapshot
+type NotebookSnapshotSpec struct {
+	// Notebook names the Jupyter, in the same namespace, whose workspace is snapshotted.
+	// +kubebuilder:validation:MinLength=1
+	Notebook string `json:"notebook"`
+
+	// StopNotebook stops the notebook until the snapshot is taken, so that
+	// the workspace isn't written to meanwhile.
+	// +optional
+	StopNotebook bool `json:"stopNotebook,omitempty"`
+
+	// VolumeSnapshotClassName is the class of the VolumeSnapshot, the
+	// cluster default when unset.
+	// +optional
+	VolumeSnapshotClassName *string `json:"volumeSnapshotClassName,omitempty"`
+}
+
+// NotebookSnapshotPhase is the progress of a NotebookSnapshot
+type NotebookSnapshotPhase string
+
+const (
+	// SnapshotStopping means the notebook is being stopped before the snapshot
+	SnapshotStopping NotebookSnapshotPhase = "Stopping"
+	// SnapshotInProgress means the VolumeSnapshot is being taken
+	SnapshotInProgress NotebookSnapshotPhase = "InProgress"
+	// SnapshotReady means the VolumeSnapshot can be restored
+	SnapshotReady NotebookSnapshotPhase = "Ready"
+	// SnapshotFailed means the snapshot can't be taken, see the message
+	SnapshotFailed NotebookSnapshotPhase = "Failed"
+)
+
+// NotebookSnapshotStatus defines the observed state of NotebookSnapshot
+type NotebookSnapshotStatus struct {
+	// +optional
+	Phase NotebookSnapshotPhase `json:"phase,omitempty"`
+
+	// VolumeSnapshotName is the VolumeSnapshot of the workspace, named after the NotebookSnapshot.
+	// +optional
+	VolumeSnapshotName string `json:"volumeSnapshotName,omitempty"`
+
+	// CompletionTime is when the snapshot became ready.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Message explains why the snapshot failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:path=notebooksnapshots,singular=notebooksnapshot,scope=Namespaced,shortName=nbs,categories=notebooks
+//+kubebuilder:printcolumn:name="Notebook",type=string,JSONPath=`.spec.notebook`,description="Snapshotted notebook"
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`,description="Snapshot phase"
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// NotebookSnapshot is the Schema for the notebooksnapshots API
+type NotebookSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NotebookSnapshotSpec   `json:"spec,omitempty"`
+	Status NotebookSnapshotStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// NotebookSnapshotList contains a list of NotebookSnapshot
+type NotebookSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NotebookSnapshot `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NotebookSnapshot{}, &NotebookSnapshotList{})
+}
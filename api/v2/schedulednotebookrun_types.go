@@ -0,0 +1,133 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConcurrencyPolicy is what happens when a run is due while another is active
+// +kubebuilder:validation:Enum=Allow;Forbid;Replace
+type ConcurrencyPolicy string
+
+const (
+	// AllowConcurrent lets runs overlap
+	AllowConcurrent ConcurrencyPolicy = "Allow"
+	// ForbidConcurrent skips the run due while another is active
+	ForbidConcurrent ConcurrencyPolicy = "Forbid"
+	// ReplaceConcurrent deletes the active runs before starting the new one
+	ReplaceConcurrent ConcurrencyPolicy = "Replace"
+)
+
+// ScheduledNotebookRunSpec defines the desired state of ScheduledNotebookRun
+type ScheduledNotebookRunSpec struct {
+	// Schedule is the cron expression at which the notebook runs, e.g. "0 6 * * *".
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+
+	// TimeZone is the IANA time zone the schedule is evaluated in. Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// StartingDeadlineSeconds is how late a missed run may still start,
+	// e.g. after an operator outage. When unset, the latest run missed over
+	// the past week still starts.
+	// +optional
+	StartingDeadlineSeconds *int64 `json:"startingDeadlineSeconds,omitempty"`
+
+	// ConcurrencyPolicy defaults to Forbid.
+	// +optional
+	ConcurrencyPolicy ConcurrencyPolicy `json:"concurrencyPolicy,omitempty"`
+
+	// Suspend stops scheduling new runs, the active ones keep running.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// SuccessfulRunsHistoryLimit is the number of succeeded runs kept, 3 by default.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	SuccessfulRunsHistoryLimit *int32 `json:"successfulRunsHistoryLimit,omitempty"`
+
+	// FailedRunsHistoryLimit is the number of failed runs kept, 1 by default.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	FailedRunsHistoryLimit *int32 `json:"failedRunsHistoryLimit,omitempty"`
+
+	// RunTemplate is the spec of the scheduled NotebookRuns. Its
+	// environment.jupyter reuses the pod template of the interactive notebook.
+	RunTemplate NotebookRunSpec `json:"runTemplate"`
+}
+
+// RunReference points to a finished NotebookRun
+type RunReference struct {
+	Name string `json:"name"`
+
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Reason explains why the run failed.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+// ScheduledNotebookRunStatus defines the observed state of ScheduledNotebookRun
+type ScheduledNotebookRunStatus struct {
+	// Active lists the runs that haven't finished.
+	// +optional
+	Active []string `json:"active,omitempty"`
+
+	// LastScheduleTime is when the last run was due.
+	// +optional
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+
+	// +optional
+	LastSuccessfulRun *RunReference `json:"lastSuccessfulRun,omitempty"`
+
+	// +optional
+	LastFailedRun *RunReference `json:"lastFailedRun,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:path=schedulednotebookruns,singular=schedulednotebookrun,scope=Namespaced,shortName=snbr,categories=notebooks
+//+kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+//+kubebuilder:printcolumn:name="Suspend",type=boolean,JSONPath=`.spec.suspend`
+//+kubebuilder:printcolumn:name="Last Schedule",type=date,JSONPath=`.status.lastScheduleTime`
+//+kubebuilder:printcolumn:name="Last Success",type=string,JSONPath=`.status.lastSuccessfulRun.name`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ScheduledNotebookRun is the Schema for the schedulednotebookruns API
+type ScheduledNotebookRun struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ScheduledNotebookRunSpec   `json:"spec,omitempty"`
+	Status ScheduledNotebookRunStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ScheduledNotebookRunList contains a list of ScheduledNotebookRun
+type ScheduledNotebookRunList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ScheduledNotebookRun `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ScheduledNotebookRun{}, &ScheduledNotebookRunList{})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+func runCreate(ctx context.Context, p *plugin, args []string) error {
+	notebook, err := newNotebook(p.namespace, args)
+	if err != nil {
+		return err
+	}
+	if err = p.client.Create(ctx, notebook); err != nil {
+		return err
+	}
+	fmt.Printf("jupyter/%s created\n", notebook.Name)
+	return nil
+}
+
+// newNotebook returns the notebook described by the arguments of create.
+func newNotebook(namespace string, args []string) (*operatorsv2.Jupyter, error) {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	profileName := fs.String("profile", "", "The preset environment of the notebook: "+profileNames()+".")
+	image := fs.String("image", "", "The image of the notebook, defaults to the operator's default image.")
+	dask := fs.String("dask", "", "The Dask cluster the notebook connects to.")
+	name, err := nameArg(fs, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// The controller finds the notebook container by the notebook name
+	container := corev1.Container{Name: name, Image: *image}
+	if *profileName != "" {
+		if *image != "" {
+			return nil, fmt.Errorf("--profile and --image are mutually exclusive")
+		}
+		pr, ok := profiles[*profileName]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q, choose one of %s", *profileName, profileNames())
+		}
+		container.Image = pr.image
+		container.Resources = pr.resources
+	}
+
+	notebook := &operatorsv2.Jupyter{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: operatorsv2.JupyterSpec{
+			Template: operatorsv2.JupyterTemplate{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{container}},
+			},
+		},
+	}
+	if *dask != "" {
+		notebook.Spec.DaskRef = &corev1.LocalObjectReference{Name: *dask}
+	}
+	return notebook, nil
+}
+
+func runList(ctx context.Context, p *plugin, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	list := &operatorsv2.JupyterList{}
+	if err := p.client.List(ctx, list, client.InNamespace(p.namespace)); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPHASE\tREADY\tURL\tAGE")
+	for _, nb := range list.Items {
+		phase := nb.Status.Phase
+		if phase == "" {
+			phase = operatorsv2.JupyterPending
+		}
+		age := duration.HumanDuration(time.Since(nb.CreationTimestamp.Time))
+		fmt.Fprintf(w, "%s\t%s\t%d/1\t%s\t%s\n", nb.Name, phase, nb.Status.ReadyReplicas, nb.Status.URL, age)
+	}
+	return w.Flush()
+}
+
+func runStop(ctx context.Context, p *plugin, args []string) error {
+	name, err := nameArg(flag.NewFlagSet("stop", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	stoppedAt := time.Now().UTC().Format(time.RFC3339)
+	if err = p.setStopped(ctx, name, &stoppedAt); err != nil {
+		return err
+	}
+	fmt.Printf("jupyter/%s stopped\n", name)
+	return nil
+}
+
+func runStart(ctx context.Context, p *plugin, args []string) error {
+	name, err := nameArg(flag.NewFlagSet("start", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	if err = p.setStopped(ctx, name, nil); err != nil {
+		return err
+	}
+	fmt.Printf("jupyter/%s started\n", name)
+	return nil
+}
+
+// setStopped sets the stopped annotation of a notebook, or removes it when
+// stoppedAt is nil.
+func (p *plugin) setStopped(ctx context.Context, name string, stoppedAt *string) error {
+	notebook := &operatorsv2.Jupyter{}
+	if err := p.client.Get(ctx, types.NamespacedName{Name: name, Namespace: p.namespace}, notebook); err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(notebook.DeepCopy())
+	if stoppedAt == nil {
+		delete(notebook.Annotations, operatorsv2.StoppedAnnotation)
+	} else {
+		if notebook.Annotations == nil {
+			notebook.Annotations = map[string]string{}
+		}
+		notebook.Annotations[operatorsv2.StoppedAnnotation] = *stoppedAt
+	}
+	return p.client.Patch(ctx, notebook, patch)
+}
+
+// notebookContainer returns the notebook container of a notebook, the first
+// one of its template.
+func notebookContainer(notebook *operatorsv2.Jupyter) (*corev1.Container, error) {
+	if len(notebook.Spec.Template.Spec.Containers) == 0 {
+		return nil, fmt.Errorf("jupyter %s has no container", notebook.Name)
+	}
+	return &notebook.Spec.Template.Spec.Containers[0], nil
+}
+
+func runLogs(ctx context.Context, p *plugin, args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	follow := fs.Bool("follow", false, "Stream the logs until interrupted.")
+	name, err := nameArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	notebook := &operatorsv2.Jupyter{}
+	if err = p.client.Get(ctx, types.NamespacedName{Name: name, Namespace: p.namespace}, notebook); err != nil {
+		return err
+	}
+
+	container, err := notebookContainer(notebook)
+	if err != nil {
+		return err
+	}
+
+	logs, err := p.clientset.CoreV1().Pods(p.namespace).GetLogs(podName(notebook), &corev1.PodLogOptions{
+		Container: container.Name,
+		Follow:    *follow,
+	}).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+
+	_, err = io.Copy(os.Stdout, logs)
+	return err
+}
+
+// podName returns the name of the single pod of the notebook StatefulSet
+func podName(notebook *operatorsv2.Jupyter) string {
+	return notebook.Name + "-0"
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestNameArg(t *testing.T) {
+	tests := []struct {
+		args    []string
+		name    string
+		port    int
+		follow  bool
+		wantErr bool
+	}{
+		{args: []string{"nb"}, name: "nb", port: 8888},
+		{args: []string{"nb", "--port", "9000"}, name: "nb", port: 9000},
+		{args: []string{"--port=9000", "nb"}, name: "nb", port: 9000},
+		{args: []string{"nb", "--follow"}, name: "nb", port: 8888, follow: true},
+		{args: []string{"--follow", "nb", "--port", "9000"}, name: "nb", port: 9000, follow: true},
+		{args: []string{}, wantErr: true},
+		{args: []string{"nb", "other"}, wantErr: true},
+		{args: []string{"nb", "--unknown"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		port := fs.Int("port", 8888, "")
+		follow := fs.Bool("follow", false, "")
+
+		name, err := nameArg(fs, tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("nameArg(%q) error = %v, want error %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if name != tt.name || *port != tt.port || *follow != tt.follow {
+			t.Errorf("nameArg(%q) = %q, port %d, follow %v, want %q, port %d, follow %v",
+				tt.args, name, *port, *follow, tt.name, tt.port, tt.follow)
+		}
+	}
+}
+
+func TestNewNotebook(t *testing.T) {
+	scipy := profiles["scipy"]
+	tests := []struct {
+		args      []string
+		container corev1.Container
+		dask      string
+		wantErr   bool
+	}{
+		{
+			args:      []string{"nb"},
+			container: corev1.Container{Name: "nb"},
+		},
+		{
+			args:      []string{"nb", "--image", "jupyter/base-notebook"},
+			container: corev1.Container{Name: "nb", Image: "jupyter/base-notebook"},
+		},
+		{
+			args:      []string{"nb", "--profile", "scipy", "--dask", "cluster"},
+			container: corev1.Container{Name: "nb", Image: scipy.image, Resources: scipy.resources},
+			dask:      "cluster",
+		},
+		{
+			args:      []string{"--profile=scipy", "nb"},
+			container: corev1.Container{Name: "nb", Image: scipy.image, Resources: scipy.resources},
+		},
+		{args: []string{"nb", "--profile", "scipy", "--image", "jupyter/base-notebook"}, wantErr: true},
+		{args: []string{"nb", "--profile", "missing"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		notebook, err := newNotebook("team", tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newNotebook(%q) error = %v, want error %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if notebook.Name != "nb" || notebook.Namespace != "team" {
+			t.Errorf("newNotebook(%q) created %s/%s, want team/nb", tt.args, notebook.Namespace, notebook.Name)
+		}
+		if containers := notebook.Spec.Template.Spec.Containers; len(containers) != 1 || !reflect.DeepEqual(containers[0], tt.container) {
+			t.Errorf("newNotebook(%q) containers = %+v, want %+v", tt.args, containers, tt.container)
+		}
+		dask := ""
+		if notebook.Spec.DaskRef != nil {
+			dask = notebook.Spec.DaskRef.Name
+		}
+		if dask != tt.dask {
+			t.Errorf("newNotebook(%q) dask = %q, want %q", tt.args, dask, tt.dask)
+		}
+	}
+}
+
+func TestNotebookContainer(t *testing.T) {
+	notebook, err := newNotebook("team", []string{"nb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container, err := notebookContainer(notebook); err != nil || container.Name != "nb" {
+		t.Errorf("notebookContainer() = %v, %v, want the nb container", container, err)
+	}
+
+	notebook.Spec.Template.Spec.Containers = nil
+	if _, err := notebookContainer(notebook); err == nil {
+		t.Error("notebookContainer() of a notebook without container succeeded")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-notebook is a kubectl plugin managing notebooks without writing
+// Jupyter manifests, installed by putting it on the PATH.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(operatorsv2.AddToScheme(scheme))
+}
+
+// command is a plugin subcommand, args excludes the subcommand name
+type command struct {
+	usage string
+	run   func(ctx context.Context, p *plugin, args []string) error
+}
+
+var commands = map[string]command{
+	"create": {"create NAME [--profile PROFILE | --image IMAGE] [--dask CLUSTER]", runCreate},
+	"list":   {"list", runList},
+	"open":   {"open NAME [--port PORT]", runOpen},
+	"stop":   {"stop NAME", runStop},
+	"start":  {"start NAME", runStart},
+	"logs":   {"logs NAME [--follow]", runLogs},
+}
+
+// plugin holds the clients of the current kubeconfig context
+type plugin struct {
+	client     client.Client
+	clientset  kubernetes.Interface
+	restConfig *rest.Config
+	namespace  string
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: kubectl notebook [-n NAMESPACE] COMMAND\n\nCommands:\n")
+	for _, name := range []string{"create", "list", "open", "stop", "start", "logs"} {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nProfiles: %s\n\nFlags:\n", profileNames())
+	flag.PrintDefaults()
+}
+
+func main() {
+	var namespace string
+	flag.StringVar(&namespace, "n", "", "The namespace of the notebooks, defaults to the one of the current context.")
+	flag.StringVar(&namespace, "namespace", "", "The namespace of the notebooks, defaults to the one of the current context.")
+	flag.Usage = usage
+	flag.Parse()
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	p, err := newPlugin(namespace)
+	if err == nil {
+		err = cmd.run(context.Background(), p, flag.Args()[1:])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func newPlugin(namespace string) (*plugin, error) {
+	restConfig, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if namespace == "" {
+		loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+		if namespace, _, err = loader.Namespace(); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &plugin{client: c, clientset: clientset, restConfig: restConfig, namespace: namespace}, nil
+}
+
+// nameArg parses the flags of a subcommand taking a single notebook name.
+// The flags may come before or after the name, as with kubectl.
+func nameArg(fs *flag.FlagSet, args []string) (string, error) {
+	var names []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return "", err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		names = append(names, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(names) != 1 {
+		return "", fmt.Errorf("expected exactly one notebook name")
+	}
+	return names[0], nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// tokenPattern finds the token in the URLs the server prints at startup
+var tokenPattern = regexp.MustCompile(`[?&]token=([0-9a-zA-Z]+)`)
+
+func runOpen(ctx context.Context, p *plugin, args []string) error {
+	fs := flag.NewFlagSet("open", flag.ContinueOnError)
+	localPort := fs.Int("port", 8888, "The local port to forward to the notebook.")
+	name, err := nameArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	notebook := &operatorsv2.Jupyter{}
+	if err = p.client.Get(ctx, types.NamespacedName{Name: name, Namespace: p.namespace}, notebook); err != nil {
+		return err
+	}
+	if notebook.Status.Phase != operatorsv2.JupyterRunning {
+		return fmt.Errorf("jupyter/%s is not running", name)
+	}
+
+	// Forward to the pod behind the notebook Service, on its target port
+	svc := &corev1.Service{}
+	if err = p.client.Get(ctx, types.NamespacedName{Name: name, Namespace: p.namespace}, svc); err != nil {
+		return err
+	}
+	if len(svc.Spec.Ports) == 0 {
+		return fmt.Errorf("service %s has no port", name)
+	}
+	remotePort := svc.Spec.Ports[0].TargetPort.IntValue()
+
+	token, err := p.notebookToken(ctx, notebook)
+	if err != nil {
+		return err
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(p.restConfig)
+	if err != nil {
+		return err
+	}
+	req := p.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").Namespace(p.namespace).Name(podName(notebook)).SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+
+	stop := make(chan struct{})
+	ready := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+
+	ports := []string{fmt.Sprintf("%d:%d", *localPort, remotePort)}
+	forwarder, err := portforward.New(dialer, ports, stop, ready, ioutil.Discard, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ready
+		url := fmt.Sprintf("http://localhost:%d/", *localPort)
+		if token != "" {
+			url += "?token=" + token
+		}
+		fmt.Printf("Open %s in your browser, press Ctrl+C to stop forwarding\n", url)
+	}()
+	return forwarder.ForwardPorts()
+}
+
+// notebookToken returns the token of the notebook server, set through the
+// JUPYTER_TOKEN env, generated by the operator or else printed in the server
+// logs. It returns an empty token when the server doesn't use one.
+func (p *plugin) notebookToken(ctx context.Context, notebook *operatorsv2.Jupyter) (string, error) {
+	container, err := notebookContainer(notebook)
+	if err != nil {
+		return "", err
+	}
+	tokenSet := false
+	for _, env := range container.Env {
+		if env.Name == "JUPYTER_TOKEN" && env.Value != "" {
+			return env.Value, nil
+		}
+		tokenSet = tokenSet || env.Name == "JUPYTER_TOKEN"
+	}
+
+	// The operator generates the token of the notebooks that don't set one
+	if !tokenSet {
+		secret := &corev1.Secret{}
+		err := p.client.Get(ctx, types.NamespacedName{Name: notebook.Name + "-token", Namespace: p.namespace}, secret)
+		if err == nil && len(secret.Data["token"]) > 0 {
+			return string(secret.Data["token"]), nil
+		}
+	}
+
+	logs, err := p.clientset.CoreV1().Pods(p.namespace).GetLogs(podName(notebook), &corev1.PodLogOptions{
+		Container: container.Name,
+	}).Stream(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer logs.Close()
+
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		if match := tokenPattern.FindStringSubmatch(scanner.Text()); match != nil {
+			return match[1], nil
+		}
+	}
+	return "", scanner.Err()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// profile is a preset notebook environment users pick by name
+type profile struct {
+	image     string
+	resources corev1.ResourceRequirements
+}
+
+func requests(cpu, memory string) corev1.ResourceRequirements {
+	return corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(memory),
+		},
+	}
+}
+
+var profiles = map[string]profile{
+	"minimal":     {"jupyter/minimal-notebook:latest", requests("500m", "1Gi")},
+	"scipy":       {"jupyter/scipy-notebook:latest", requests("1", "2Gi")},
+	"datascience": {"jupyter/datascience-notebook:latest", requests("2", "4Gi")},
+	"pyspark":     {"jupyter/pyspark-notebook:latest", requests("2", "8Gi")},
+}
+
+func profileNames() string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -1,19 +1,188 @@
 package controllers
 
 import (
-	"reflect"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
 	operatorsv2 "convect.ai/notebook-crd/api/v2"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-func generateStatefulSet(instance *operatorsv2.Jupyter) *appsv1.StatefulSet {
-	replicas := int32(1)
+// fieldOwner is the field manager the controllers server-side apply with
+const fieldOwner = client.FieldOwner("notebook-operator")
+
+const (
+	daskSchedulerPort = 8786
+	daskDashboardPort = 8787
+)
+
+// notebookPhase summarises the notebook state from its StatefulSet.
+func notebookPhase(replicas, readyReplicas int32) operatorsv2.JupyterPhase {
+	switch {
+	case replicas == 0:
+		return operatorsv2.JupyterStopped
+	case readyReplicas > 0:
+		return operatorsv2.JupyterRunning
+	default:
+		return operatorsv2.JupyterPending
+	}
+}
+
+// notebookURL returns the in-cluster URL of the notebook server
+func notebookURL(instance *operatorsv2.Jupyter) string {
+	return fmt.Sprintf("http://%s.%s.svc", instance.Name, instance.Namespace)
+}
+
+// ApplyContainerDefaults fills in the admin-configured image and resources
+// of a container that doesn't set them. The quota webhook applies them too,
+// to count what the pods will request.
+func ApplyContainerDefaults(container *corev1.Container, image string, resources corev1.ResourceRequirements) {
+	if container.Image == "" {
+		container.Image = image
+	}
+	if container.Resources.Requests == nil && resources.Requests != nil {
+		container.Resources.Requests = resources.Requests.DeepCopy()
+	}
+	if container.Resources.Limits == nil && resources.Limits != nil {
+		container.Resources.Limits = resources.Limits.DeepCopy()
+	}
+}
+
+// stampRestartedAt copies the restartedAt annotation of a CR to its pod
+// template, so that the pods roll whenever the value changes.
+func stampRestartedAt(template *corev1.PodTemplateSpec, annotations map[string]string) {
+	restartedAt, ok := annotations[operatorsv2.RestartedAtAnnotation]
+	if !ok {
+		return
+	}
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[operatorsv2.RestartedAtAnnotation] = restartedAt
+}
+
+// applyObject server-side applies an owned object, taking over any field
+// another manager set before. The object must carry its apiVersion and kind,
+// and is updated in place with the state returned by the API server.
+func applyObject(ctx context.Context, c client.Client, obj client.Object) error {
+	return c.Patch(ctx, obj, client.Apply, fieldOwner, client.ForceOwnership)
+}
+
+// deleteIfOwned deletes the object of the given name and type when owner
+// controls it, e.g. an object generated for a feature since disabled.
+func deleteIfOwned(ctx context.Context, c client.Client, owner metav1.Object, name string, obj client.Object) error {
+	if err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: owner.GetNamespace()}, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(obj, owner) {
+		return nil
+	}
+	return client.IgnoreNotFound(c.Delete(ctx, obj))
+}
+
+// requeueAfter makes result requeue after d, unless it already requeues sooner.
+func requeueAfter(result *ctrl.Result, d time.Duration) {
+	if result.RequeueAfter == 0 || d < result.RequeueAfter {
+		result.RequeueAfter = d
+	}
+}
+
+// daskLabels returns the labels identifying one component of a Dask cluster.
+func daskLabels(name, component string) map[string]string {
+	return map[string]string{
+		"dask-cluster":   name,
+		"dask-component": component,
+	}
+}
+
+// notebookPort returns the port the notebook server listens on.
+func notebookPort(instance *operatorsv2.Jupyter) int {
+	port := 8888
 
+	containerPorts := instance.Spec.Template.Spec.Containers[0].Ports
+
+	if containerPorts != nil {
+		port = int(containerPorts[0].ContainerPort)
+	}
+	return port
+}
+
+// setDefaultEnv sets an env variable of a container, unless it already sets it.
+func setDefaultEnv(container *corev1.Container, name, value string) {
+	setDefaultEnvVar(container, corev1.EnvVar{Name: name, Value: value})
+}
+
+// setDefaultEnvVar adds env to a container, unless it already sets the variable.
+func setDefaultEnvVar(container *corev1.Container, env corev1.EnvVar) {
+	for _, e := range container.Env {
+		if e.Name == env.Name {
+			return
+		}
+	}
+	container.Env = append(container.Env, env)
+}
+
+// notebookUser turns a creator, e.g. an email, into a valid Linux user name
+// for the home directory and the uid of the notebook.
+func notebookUser(creator string) string {
+	if i := strings.IndexByte(creator, '@'); i > 0 {
+		creator = creator[:i]
+	}
+	user := []byte(strings.ToLower(creator))
+	for i, c := range user {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			user[i] = '-'
+		}
+	}
+	if len(user) > 32 {
+		user = user[:32]
+	}
+	if len(user) == 0 || user[0] < 'a' || user[0] > 'z' {
+		return "u" + string(user)
+	}
+	return string(user)
+}
+
+// tokenEnv is the variable the Jupyter server reads its token from
+const tokenEnv = "JUPYTER_TOKEN"
+
+// tokenKey is the key of the token in the Secret generated for a notebook
+const tokenKey = "token"
+
+// notebookTokenName returns the name of the Secret holding the token of a
+// notebook server.
+func notebookTokenName(instance *operatorsv2.Jupyter) string {
+	return instance.Name + "-token"
+}
+
+func generateTokenSecret(instance *operatorsv2.Jupyter, token string) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      notebookTokenName(instance),
+			Namespace: instance.Namespace,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{tokenKey: []byte(token)},
+	}
+}
+
+func generateStatefulSet(instance *operatorsv2.Jupyter, replicas int32) *appsv1.StatefulSet {
 	statefulSet := &appsv1.StatefulSet{
+		TypeMeta: metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "StatefulSet"},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      instance.Name,
 			Namespace: instance.Namespace,
@@ -27,28 +196,71 @@ func generateStatefulSet(instance *operatorsv2.Jupyter) *appsv1.StatefulSet {
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"statefulset":   instance.Name,
-						"notebook-name": instance.Name,
-					},
+					Labels:      map[string]string{},
+					Annotations: map[string]string{},
 				},
-				Spec: instance.Spec.Template.Spec,
+				Spec: *instance.Spec.Template.Spec.DeepCopy(),
 			},
 		},
 	}
-	// copy all of the Notebook labels to the pod including poddefault related labels
-	labels := &statefulSet.Spec.Template.ObjectMeta.Labels
+	// copy all of the Notebook labels to the pod including poddefault related labels,
+	// then the template's own metadata, without letting either replace the selector labels
+	labels := statefulSet.Spec.Template.ObjectMeta.Labels
 	for k, v := range instance.ObjectMeta.Labels {
-		(*labels)[k] = v
+		labels[k] = v
 	}
+	for k, v := range instance.Spec.Template.Metadata.Labels {
+		labels[k] = v
+	}
+	labels["statefulset"] = instance.Name
+	labels["notebook-name"] = instance.Name
+
+	annotations := statefulSet.Spec.Template.ObjectMeta.Annotations
+	for k, v := range instance.Spec.Template.Metadata.Annotations {
+		annotations[k] = v
+	}
+	stampRestartedAt(&statefulSet.Spec.Template, instance.Annotations)
 
 	podSpec := &statefulSet.Spec.Template.Spec
 	container := &podSpec.Containers[0]
 
+	if instance.Spec.ServiceAccount != nil {
+		podSpec.ServiceAccountName = instance.Name
+	}
+
 	if container.WorkingDir == "" {
 		container.WorkingDir = "/home/jovyan"
 	}
 
+	if workspace := instance.Spec.Workspace; workspace != nil {
+		mountPath := workspace.MountPath
+		if mountPath == "" {
+			mountPath = "/home/jovyan"
+		}
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "workspace",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: workspaceName(instance)},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: "workspace", MountPath: mountPath})
+	}
+
+	// The operator authenticates with the generated token, unless the
+	// notebook sets its own
+	setDefaultEnvVar(container, corev1.EnvVar{
+		Name: tokenEnv,
+		ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: notebookTokenName(instance)},
+			Key:                  tokenKey,
+		}},
+	})
+
+	if creator := instance.Annotations[operatorsv2.CreatorAnnotation]; creator != "" {
+		setDefaultEnv(container, "NB_USER", notebookUser(creator))
+		setDefaultEnv(container, "JUPYTERHUB_USER", creator)
+	}
+
 	if container.Ports == nil {
 		container.Ports = []corev1.ContainerPort{
 			{
@@ -63,15 +275,10 @@ func generateStatefulSet(instance *operatorsv2.Jupyter) *appsv1.StatefulSet {
 }
 
 func generateService(instance *operatorsv2.Jupyter) *corev1.Service {
-	port := 8888
-
-	containerPorts := instance.Spec.Template.Spec.Containers[0].Ports
-
-	if containerPorts != nil {
-		port = int(containerPorts[0].ContainerPort)
-	}
+	port := notebookPort(instance)
 
 	svc := &corev1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Service"},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      instance.Name,
 			Namespace: instance.Namespace,
@@ -96,65 +303,453 @@ func generateService(instance *operatorsv2.Jupyter) *corev1.Service {
 
 }
 
-// CopyStatefulSetFields copies the owned fields from one StatefulSet to another
-// Returns true if the fields copied from don't match to.
-func copyStatefulSetFields(from, to *appsv1.StatefulSet) bool {
-	requireUpdate := false
-	for k, v := range to.Labels {
-		if from.Labels[k] != v {
-			requireUpdate = true
+// operatorPeer returns the peer matching the operator pods.
+func operatorPeer(opts configv1alpha1.NetworkPolicyConfig) networkingv1.NetworkPolicyPeer {
+	if opts.OperatorPeer != nil {
+		return *opts.OperatorPeer.DeepCopy()
+	}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"control-plane": "controller-manager"}}
+	return networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: selector,
+		PodSelector:       selector.DeepCopy(),
+	}
+}
+
+func generateNetworkPolicy(instance *operatorsv2.Jupyter, opts configv1alpha1.NetworkPolicyConfig) *networkingv1.NetworkPolicy {
+	tcp := corev1.ProtocolTCP
+	udp := corev1.ProtocolUDP
+	notebookPort := intstr.FromInt(notebookPort(instance))
+	dnsPort := intstr.FromInt(53)
+
+	// The operator polls the server for culling and update policies
+	from := []networkingv1.NetworkPolicyPeer{operatorPeer(opts)}
+	if opts.IngressNamespaceSelector != nil {
+		from = append(from, networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: opts.IngressNamespaceSelector,
+		})
+	}
+	if opts.AuthProxySelector != nil {
+		from = append(from, networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{},
+			PodSelector:       opts.AuthProxySelector,
+		})
+	}
+
+	np := &networkingv1.NetworkPolicy{
+		TypeMeta: metav1.TypeMeta{APIVersion: networkingv1.SchemeGroupVersion.String(), Kind: "NetworkPolicy"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name,
+			Namespace: instance.Namespace,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"statefulset": instance.Name,
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{
+				networkingv1.PolicyTypeIngress,
+				networkingv1.PolicyTypeEgress,
+			},
+			Egress: []networkingv1.NetworkPolicyEgressRule{
+				{
+					Ports: []networkingv1.NetworkPolicyPort{
+						{Protocol: &udp, Port: &dnsPort},
+						{Protocol: &tcp, Port: &dnsPort},
+					},
+				},
+			},
+		},
+	}
+
+	np.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{
+		{
+			From: from,
+			Ports: []networkingv1.NetworkPolicyPort{
+				{Protocol: &tcp, Port: &notebookPort},
+			},
+		},
+	}
+
+	if instance.Spec.DaskRef != nil {
+		schedulerPort := intstr.FromInt(daskSchedulerPort)
+		dashboardPort := intstr.FromInt(daskDashboardPort)
+		np.Spec.Egress = append(np.Spec.Egress, networkingv1.NetworkPolicyEgressRule{
+			To: []networkingv1.NetworkPolicyPeer{
+				{
+					PodSelector: &metav1.LabelSelector{
+						MatchLabels: daskLabels(instance.Spec.DaskRef.Name, "scheduler"),
+					},
+				},
+			},
+			Ports: []networkingv1.NetworkPolicyPort{
+				{Protocol: &tcp, Port: &schedulerPort},
+				{Protocol: &tcp, Port: &dashboardPort},
+			},
+		})
+	}
+
+	if len(opts.EgressCIDRs) > 0 {
+		to := make([]networkingv1.NetworkPolicyPeer, 0, len(opts.EgressCIDRs))
+		for _, cidr := range opts.EgressCIDRs {
+			to = append(to, networkingv1.NetworkPolicyPeer{
+				IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+			})
 		}
+		np.Spec.Egress = append(np.Spec.Egress, networkingv1.NetworkPolicyEgressRule{To: to})
+	}
+
+	return np
+}
+
+// workspaceName returns the name of the workspace PersistentVolumeClaim of a notebook
+func workspaceName(instance *operatorsv2.Jupyter) string {
+	return instance.Name + "-workspace"
+}
+
+func generateWorkspacePVC(instance *operatorsv2.Jupyter) *corev1.PersistentVolumeClaim {
+	workspace := instance.Spec.Workspace
+	pvc := &corev1.PersistentVolumeClaim{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "PersistentVolumeClaim"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      workspaceName(instance),
+			Namespace: instance.Namespace,
+			Labels: map[string]string{
+				"notebook-name": instance.Name,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: workspace.Size},
+			},
+			StorageClassName: workspace.StorageClassName,
+		},
 	}
-	to.Labels = from.Labels
 
-	for k, v := range to.Annotations {
-		if from.Annotations[k] != v {
-			requireUpdate = true
+	// The VolumeSnapshot of a NotebookSnapshot has the same name
+	if workspace.FromSnapshot != "" {
+		pvc.Spec.DataSource = &corev1.TypedLocalObjectReference{
+			APIGroup: &volumeSnapshotGVK.Group,
+			Kind:     volumeSnapshotGVK.Kind,
+			Name:     workspace.FromSnapshot,
 		}
 	}
-	to.Annotations = from.Annotations
+	return pvc
+}
 
-	if from.Spec.Replicas != to.Spec.Replicas {
-		to.Spec.Replicas = from.Spec.Replicas
-		requireUpdate = true
+func generateServiceAccount(instance *operatorsv2.Jupyter) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "ServiceAccount"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name,
+			Namespace: instance.Namespace,
+		},
 	}
+}
 
-	if !reflect.DeepEqual(to.Spec.Template.Spec, from.Spec.Template.Spec) {
-		requireUpdate = true
+func generateRoleBinding(instance *operatorsv2.Jupyter) *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{
+		TypeMeta: metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name,
+			Namespace: instance.Namespace,
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     instance.Spec.ServiceAccount.ClusterRole,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      instance.Name,
+				Namespace: instance.Namespace,
+			},
+		},
+	}
+}
+
+// daskSchedulerAddress returns the in-cluster address of a Dask scheduler
+func daskSchedulerAddress(instance *operatorsv2.Dask) string {
+	protocol := "tcp"
+	if instance.Spec.TLS {
+		protocol = "tls"
 	}
-	to.Spec.Template.Spec = from.Spec.Template.Spec
+	return fmt.Sprintf("%s://%s.%s.svc:%d", protocol, daskSchedulerHost(instance), instance.Namespace, daskSchedulerPort)
+}
 
-	return requireUpdate
+// daskSchedulerHost returns the name of the Service of a Dask scheduler
+func daskSchedulerHost(instance *operatorsv2.Dask) string {
+	return instance.Name + "-scheduler"
+}
+
+// daskDashboardPrefix returns the path the dashboard of a Dask scheduler is
+// served under, none unless the dashboards are exposed through an Ingress.
+func daskDashboardPrefix(instance *operatorsv2.Dask, config configv1alpha1.DaskConfig) string {
+	if config.DashboardIngress == nil {
+		return ""
+	}
+	return fmt.Sprintf("/dask/%s/%s", instance.Namespace, instance.Name)
+}
+
+// daskDashboardURL returns the in-cluster address of a Dask scheduler dashboard
+func daskDashboardURL(instance *operatorsv2.Dask, config configv1alpha1.DaskConfig) string {
+	return fmt.Sprintf("http://%s-scheduler.%s.svc:%d%s", instance.Name, instance.Namespace, daskDashboardPort, daskDashboardPrefix(instance, config))
+}
+
+// daskPublicDashboardURL returns the address users open the dashboard of a
+// Dask scheduler at.
+func daskPublicDashboardURL(instance *operatorsv2.Dask, config configv1alpha1.DaskConfig) string {
+	ingress := config.DashboardIngress
+	if ingress == nil {
+		return daskDashboardURL(instance, config)
+	}
+	scheme := "http"
+	if ingress.TLSSecretName != "" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s/status", scheme, ingress.Host, daskDashboardPrefix(instance, config))
 }
 
-// CopyServiceFields copies the owned fields from one Service to another
-func copyServiceFields(from, to *corev1.Service) bool {
-	requireUpdate := false
-	for k, v := range to.Labels {
-		if from.Labels[k] != v {
-			requireUpdate = true
+func generateSchedulerDeployment(instance *operatorsv2.Dask, dashboardPrefix string) *appsv1.Deployment {
+	replicas := int32(1)
+	labels := daskLabels(instance.Name, "scheduler")
+
+	deploy := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name + "-scheduler",
+			Namespace: instance.Namespace,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: daskLabels(instance.Name, "scheduler"),
+				},
+				Spec: *instance.Spec.SchedulerTemplate.Spec.DeepCopy(),
+			},
+		},
+	}
+	stampRestartedAt(&deploy.Spec.Template, instance.Annotations)
+
+	container := &deploy.Spec.Template.Spec.Containers[0]
+
+	if container.Command == nil && container.Args == nil {
+		container.Args = []string{"dask-scheduler"}
+		if dashboardPrefix != "" {
+			container.Args = append(container.Args, "--dashboard-prefix", dashboardPrefix)
+		}
+		if instance.Spec.TLS {
+			container.Args = append(container.Args, "--protocol", "tls")
 		}
 	}
-	to.Labels = from.Labels
+	if instance.Spec.TLS {
+		mountDaskConfig(&deploy.Spec.Template.Spec, daskTLSSecretName(instance), false)
+	}
 
-	for k, v := range to.Annotations {
-		if from.Annotations[k] != v {
-			requireUpdate = true
+	if container.Ports == nil {
+		container.Ports = []corev1.ContainerPort{
+			{
+				ContainerPort: daskSchedulerPort,
+				Protocol:      "TCP",
+				Name:          "tcp-comm",
+			},
+			{
+				ContainerPort: daskDashboardPort,
+				Protocol:      "TCP",
+				Name:          "http-dashboard",
+			},
 		}
 	}
-	to.Annotations = from.Annotations
 
-	// Don't copy the entire Spec, because we can't overwrite the clusterIp field
+	return deploy
+}
 
-	if !reflect.DeepEqual(to.Spec.Selector, from.Spec.Selector) {
-		requireUpdate = true
+func generateSchedulerService(instance *operatorsv2.Dask) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name + "-scheduler",
+			Namespace: instance.Namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     "ClusterIP",
+			Selector: daskLabels(instance.Name, "scheduler"),
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "tcp-comm",
+					Port:       daskSchedulerPort,
+					TargetPort: intstr.FromInt(daskSchedulerPort),
+					Protocol:   "TCP",
+				},
+				{
+					Name:       "http-dashboard",
+					Port:       daskDashboardPort,
+					TargetPort: intstr.FromInt(daskDashboardPort),
+					Protocol:   "TCP",
+				},
+			},
+		},
+	}
+}
+
+// workerDeploymentName returns the name of the Deployment of a worker group,
+// the default group keeping the name it had before groups existed.
+func workerDeploymentName(instance *operatorsv2.Dask, group *operatorsv2.DaskWorkerGroup) string {
+	if group.Name == "" {
+		return instance.Name + "-worker"
 	}
-	to.Spec.Selector = from.Spec.Selector
+	return instance.Name + "-worker-" + group.Name
+}
 
-	if !reflect.DeepEqual(to.Spec.Ports, from.Spec.Ports) {
-		requireUpdate = true
+// workerLabels returns the labels of the workers of a group.
+func workerLabels(instance *operatorsv2.Dask, group *operatorsv2.DaskWorkerGroup) map[string]string {
+	labels := daskLabels(instance.Name, "worker")
+	if group.Name != "" {
+		labels["dask-worker-group"] = group.Name
 	}
-	to.Spec.Ports = from.Spec.Ports
+	return labels
+}
+
+func generateWorkerDeployment(instance *operatorsv2.Dask, group *operatorsv2.DaskWorkerGroup) *appsv1.Deployment {
+	replicas := int32(1)
+	if group.Replicas != nil {
+		replicas = *group.Replicas
+	}
+	if _, stopped := instance.Annotations[operatorsv2.StoppedAnnotation]; stopped {
+		replicas = 0
+	}
+	labels := workerLabels(instance, group)
+
+	deploy := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      workerDeploymentName(instance, group),
+			Namespace: instance.Namespace,
+			Labels:    workerLabels(instance, group),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: workerLabels(instance, group),
+				},
+				Spec: *group.Template.Spec.DeepCopy(),
+			},
+		},
+	}
+	stampRestartedAt(&deploy.Spec.Template, instance.Annotations)
+
+	address := daskSchedulerAddress(instance)
+	container := &deploy.Spec.Template.Spec.Containers[0]
+
+	if container.Command == nil && container.Args == nil {
+		container.Args = []string{"dask-worker", address}
+		if len(group.Resources) > 0 {
+			container.Args = append(container.Args, "--resources", workerResources(group.Resources))
+		}
+	}
+	// The worker template may point its workers elsewhere, e.g. through a proxy
+	setDefaultEnv(container, "DASK_SCHEDULER_ADDRESS", address)
+	if instance.Spec.TLS {
+		mountDaskConfig(&deploy.Spec.Template.Spec, daskTLSSecretName(instance), false)
+	}
+
+	return deploy
+}
+
+// workerResources formats resources as the dask-worker --resources value.
+func workerResources(resources map[string]string) string {
+	pairs := make([]string, 0, len(resources))
+	for name, value := range resources {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func generateDashboardIngress(instance *operatorsv2.Dask, config configv1alpha1.DaskConfig) *networkingv1.Ingress {
+	options := config.DashboardIngress
+	pathType := networkingv1.PathTypePrefix
+	ingress := &networkingv1.Ingress{
+		TypeMeta: metav1.TypeMeta{APIVersion: networkingv1.SchemeGroupVersion.String(), Kind: "Ingress"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        instance.Name + "-dashboard",
+			Namespace:   instance.Namespace,
+			Labels:      daskLabels(instance.Name, "scheduler"),
+			Annotations: options.Annotations,
+		},
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: options.IngressClassName,
+			Rules: []networkingv1.IngressRule{{
+				Host: options.Host,
+				IngressRuleValue: networkingv1.IngressRuleValue{
+					HTTP: &networkingv1.HTTPIngressRuleValue{
+						Paths: []networkingv1.HTTPIngressPath{{
+							Path:     daskDashboardPrefix(instance, config),
+							PathType: &pathType,
+							Backend: networkingv1.IngressBackend{
+								Service: &networkingv1.IngressServiceBackend{
+									Name: instance.Name + "-scheduler",
+									Port: networkingv1.ServiceBackendPort{Name: "http-dashboard"},
+								},
+							},
+						}},
+					},
+				},
+			}},
+		},
+	}
+	if options.TLSSecretName != "" {
+		ingress.Spec.TLS = []networkingv1.IngressTLS{{
+			Hosts:      []string{options.Host},
+			SecretName: options.TLSSecretName,
+		}}
+	}
+	return ingress
+}
+
+// generatePodDisruptionBudget returns a PodDisruptionBudget of the pods
+// matching labels. Exactly one of minAvailable and maxUnavailable is set.
+func generatePodDisruptionBudget(name, namespace string, labels map[string]string, minAvailable, maxUnavailable *intstr.IntOrString) *policyv1beta1.PodDisruptionBudget {
+	return &policyv1beta1.PodDisruptionBudget{
+		TypeMeta: metav1.TypeMeta{APIVersion: policyv1beta1.SchemeGroupVersion.String(), Kind: "PodDisruptionBudget"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			Selector:       &metav1.LabelSelector{MatchLabels: labels},
+			MinAvailable:   minAvailable,
+			MaxUnavailable: maxUnavailable,
+		},
+	}
+}
+
+// generateNotebookPDB keeps node drains from evicting a running notebook.
+func generateNotebookPDB(instance *operatorsv2.Jupyter) *policyv1beta1.PodDisruptionBudget {
+	none := intstr.FromInt(0)
+	return generatePodDisruptionBudget(instance.Name, instance.Namespace, map[string]string{"statefulset": instance.Name}, nil, &none)
+}
+
+// generateSchedulerPDB keeps node drains from evicting a Dask scheduler,
+// which holds the task graph of the cluster.
+func generateSchedulerPDB(instance *operatorsv2.Dask) *policyv1beta1.PodDisruptionBudget {
+	none := intstr.FromInt(0)
+	return generatePodDisruptionBudget(daskSchedulerHost(instance), instance.Namespace, daskLabels(instance.Name, "scheduler"), nil, &none)
+}
 
-	return requireUpdate
+// generateWorkerPDB keeps spec.workerMinAvailable workers of a group running
+// through node drains.
+func generateWorkerPDB(instance *operatorsv2.Dask, group *operatorsv2.DaskWorkerGroup) *policyv1beta1.PodDisruptionBudget {
+	return generatePodDisruptionBudget(workerDeploymentName(instance, group), instance.Namespace, workerLabels(instance, group), instance.Spec.WorkerMinAvailable, nil)
 }
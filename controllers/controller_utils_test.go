@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("Notebook user", func() {
+	It("Should derive a Linux user name from the creator", func() {
+		Expect(notebookUser("Alice.Smith@example.com")).To(Equal("alice-smith"))
+		Expect(notebookUser("system:serviceaccount:ci:deployer")).To(Equal("system-serviceaccount-ci-deploye"))
+		Expect(notebookUser("42")).To(Equal("u42"))
+	})
+})
+
+var _ = Describe("Notebook NetworkPolicy", func() {
+	It("Should let the operator reach an isolated notebook", func() {
+		notebook := &operatorsv2.Jupyter{
+			ObjectMeta: metav1.ObjectMeta{Name: "isolated", Namespace: "default"},
+			Spec: operatorsv2.JupyterSpec{
+				Template: operatorsv2.JupyterTemplate{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "isolated"}}},
+				},
+				Isolation: true,
+			},
+		}
+		np := generateNetworkPolicy(notebook, configv1alpha1.NetworkPolicyConfig{})
+		Expect(np.Spec.Ingress).To(HaveLen(1))
+		Expect(np.Spec.Ingress[0].From).To(ConsistOf(networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"control-plane": "controller-manager"}},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"control-plane": "controller-manager"}},
+		}))
+		Expect(np.Spec.Ingress[0].Ports[0].Port.IntValue()).To(Equal(8888))
+	})
+})
+
+var _ = Describe("Dask workers", func() {
+	newDask := func(tls bool, env ...corev1.EnvVar) *operatorsv2.Dask {
+		return &operatorsv2.Dask{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default"},
+			Spec: operatorsv2.DaskSpec{
+				TLS: tls,
+				WorkerTemplate: operatorsv2.WorkerTemplate{Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "worker", Env: env}},
+				}},
+			},
+		}
+	}
+	schedulerAddress := func(instance *operatorsv2.Dask) []string {
+		var values []string
+		deploy := generateWorkerDeployment(instance, &instance.EffectiveWorkerGroups()[0])
+		for _, env := range deploy.Spec.Template.Spec.Containers[0].Env {
+			if env.Name == "DASK_SCHEDULER_ADDRESS" {
+				values = append(values, env.Value)
+			}
+		}
+		return values
+	}
+
+	It("Should point the workers to the scheduler", func() {
+		Expect(schedulerAddress(newDask(false))).To(Equal([]string{"tcp://cluster-scheduler.default.svc:8786"}))
+		Expect(schedulerAddress(newDask(true))).To(Equal([]string{"tls://cluster-scheduler.default.svc:8786"}))
+	})
+
+	It("Should keep the scheduler address set by the template", func() {
+		instance := newDask(false, corev1.EnvVar{Name: "DASK_SCHEDULER_ADDRESS", Value: "tcp://proxy:8786"})
+		Expect(schedulerAddress(instance)).To(Equal([]string{"tcp://proxy:8786"}))
+	})
+})
@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// cullCheckPeriod is how often the activity of a running notebook is polled
+const cullCheckPeriod = time.Minute
+
+// drainIdleTime is how long a notebook server stays protected from node
+// drains after its last activity
+const drainIdleTime = 10 * time.Minute
+
+// noticeFile is written at the root of a notebook server to warn its user of
+// a pending action
+const noticeFile = "NOTEBOOK-NOTICE.txt"
+
+// ServerStatus is the activity reported by a Jupyter server
+type ServerStatus struct {
+	LastActivity time.Time `json:"last_activity"`
+	Connections  int       `json:"connections"`
+	Kernels      int       `json:"kernels"`
+}
+
+// JupyterClient talks to the Jupyter servers run by the operator
+type JupyterClient interface {
+	// Status returns the activity of the server of a notebook
+	Status(ctx context.Context, instance *operatorsv2.Jupyter) (*ServerStatus, error)
+
+	// Notify shows message to the user of a notebook
+	Notify(ctx context.Context, instance *operatorsv2.Jupyter, message string) error
+
+	// Dismiss removes the message shown by Notify, if any
+	Dismiss(ctx context.Context, instance *operatorsv2.Jupyter) error
+}
+
+// NewJupyterClient returns a JupyterClient reaching the servers through
+// their Service, authenticated with the token of their container read
+// through kube.
+func NewJupyterClient(kube client.Client) JupyterClient {
+	return &httpJupyterClient{
+		client: &http.Client{Timeout: 10 * time.Second},
+		kube:   kube,
+	}
+}
+
+type httpJupyterClient struct {
+	client *http.Client
+	kube   client.Client
+}
+
+// header returns the headers authenticating to the server of a notebook, with
+// the JUPYTER_TOKEN its container is given.
+func (c *httpJupyterClient) header(ctx context.Context, instance *operatorsv2.Jupyter) (http.Header, error) {
+	token := ""
+	for _, env := range generateStatefulSet(instance, 1).Spec.Template.Spec.Containers[0].Env {
+		if env.Name != tokenEnv {
+			continue
+		}
+		token = env.Value
+		if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+			ref := env.ValueFrom.SecretKeyRef
+			secret := &corev1.Secret{}
+			if err := c.kube.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: instance.Namespace}, secret); err != nil {
+				return nil, err
+			}
+			token = string(secret.Data[ref.Key])
+		}
+	}
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "token "+token)
+	}
+	return header, nil
+}
+
+func (c *httpJupyterClient) Status(ctx context.Context, instance *operatorsv2.Jupyter) (*ServerStatus, error) {
+	header, err := c.header(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	status := &ServerStatus{}
+	if err := getJSON(ctx, c.client, notebookURL(instance)+"/api/status", header, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Notify writes message to the notice file through the contents API, so that
+// it shows up in the file browser.
+func (c *httpJupyterClient) Notify(ctx context.Context, instance *operatorsv2.Jupyter, message string) error {
+	header, err := c.header(ctx, instance)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"type": "file", "format": "text", "content": message})
+	if err != nil {
+		return err
+	}
+	return sendJSON(ctx, c.client, http.MethodPut, notebookURL(instance)+"/api/contents/"+noticeFile, header, body,
+		http.StatusOK, http.StatusCreated)
+}
+
+func (c *httpJupyterClient) Dismiss(ctx context.Context, instance *operatorsv2.Jupyter) error {
+	header, err := c.header(ctx, instance)
+	if err != nil {
+		return err
+	}
+	return sendJSON(ctx, c.client, http.MethodDelete, notebookURL(instance)+"/api/contents/"+noticeFile, header, nil,
+		http.StatusNoContent, http.StatusNotFound)
+}
+
+// SchedulerStatus is the activity reported by a Dask scheduler
+type SchedulerStatus struct {
+	// Clients includes the client the scheduler keeps for fire-and-forget
+	// tasks, so it is 1 when no user client is connected
+	Clients    int `json:"clients"`
+	Processing int `json:"processing"`
+	Waiting    int `json:"waiting"`
+}
+
+// Busy reports whether a user client is connected or a task is queued or running.
+func (s *SchedulerStatus) Busy() bool {
+	return s.Clients > 1 || s.Processing > 0 || s.Waiting > 0
+}
+
+// DaskClient talks to the Dask schedulers run by the operator
+type DaskClient interface {
+	// Status returns the activity of the scheduler of a Dask cluster
+	Status(ctx context.Context, instance *operatorsv2.Dask) (*SchedulerStatus, error)
+}
+
+// NewDaskClient returns a DaskClient reaching the scheduler dashboards
+// through their Service, under the prefix config serves them at.
+func NewDaskClient(config configv1alpha1.DaskConfig) DaskClient {
+	return &httpDaskClient{
+		client: &http.Client{Timeout: 10 * time.Second},
+		config: config,
+	}
+}
+
+type httpDaskClient struct {
+	client *http.Client
+	config configv1alpha1.DaskConfig
+}
+
+func (c *httpDaskClient) Status(ctx context.Context, instance *operatorsv2.Dask) (*SchedulerStatus, error) {
+	status := &SchedulerStatus{}
+	if err := getJSON(ctx, c.client, daskDashboardURL(instance, c.config)+"/json/counts.json", nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// getJSON decodes the JSON document at url, requested with header, into v.
+func getJSON(ctx context.Context, client *http.Client, url string, header http.Header, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, req.URL)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// sendJSON sends body, when not nil, as JSON to url with header and fails
+// unless the response has one of the expected statuses.
+func sendJSON(ctx context.Context, client *http.Client, method, url string, header http.Header, body []byte, expected ...int) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, req.URL)
+}
+
+// isIdle reports whether a server has had no connection nor activity for
+// longer than idleTime at now.
+func isIdle(status *ServerStatus, idleTime time.Duration, now time.Time) bool {
+	return status.Connections == 0 && now.Sub(status.LastActivity) > idleTime
+}
+
+// inUse reports whether the user of a server is active enough at now to
+// protect it from node drains. A server that can't be reached isn't.
+func inUse(status *ServerStatus, now time.Time) bool {
+	return status != nil && !isIdle(status, drainIdleTime, now)
+}
@@ -0,0 +1,411 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("Notebook culling", func() {
+	now := time.Date(2021, time.June, 2, 12, 0, 0, 0, time.UTC)
+
+	It("Should cull a server idle for longer than the idle time", func() {
+		status := &ServerStatus{LastActivity: now.Add(-5 * time.Hour)}
+		Expect(isIdle(status, 4*time.Hour, now)).To(BeTrue())
+	})
+
+	It("Should keep a recently active server", func() {
+		status := &ServerStatus{LastActivity: now.Add(-time.Hour), Kernels: 1}
+		Expect(isIdle(status, 4*time.Hour, now)).To(BeFalse())
+	})
+
+	It("Should keep a server with an open connection", func() {
+		status := &ServerStatus{LastActivity: now.Add(-5 * time.Hour), Connections: 1}
+		Expect(isIdle(status, 4*time.Hour, now)).To(BeFalse())
+	})
+})
+
+var _ = Describe("Jupyter client", func() {
+	notebook := func(env ...corev1.EnvVar) *operatorsv2.Jupyter {
+		return &operatorsv2.Jupyter{
+			ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default"},
+			Spec: operatorsv2.JupyterSpec{
+				Template: operatorsv2.JupyterTemplate{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "token", Env: env}}},
+				},
+			},
+		}
+	}
+
+	newClient := func(objs ...runtime.Object) *httpJupyterClient {
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		return NewJupyterClient(fake.NewFakeClientWithScheme(scheme, objs...)).(*httpJupyterClient)
+	}
+
+	It("Should authenticate with the generated token", func() {
+		instance := notebook()
+		c := newClient(generateTokenSecret(instance, "generated"))
+		header, err := c.header(context.Background(), instance)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(header.Get("Authorization")).To(Equal("token generated"))
+	})
+
+	It("Should authenticate with the token set by the notebook", func() {
+		instance := notebook(corev1.EnvVar{Name: "JUPYTER_TOKEN", Value: "chosen"})
+		header, err := newClient().header(context.Background(), instance)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(header.Get("Authorization")).To(Equal("token chosen"))
+	})
+
+	It("Should fail until the token Secret exists", func() {
+		_, err := newClient().header(context.Background(), notebook())
+		Expect(apierrs.IsNotFound(err)).To(BeTrue())
+	})
+})
+
+type fakeDaskClient struct {
+	status *SchedulerStatus
+}
+
+func (c *fakeDaskClient) Status(ctx context.Context, instance *operatorsv2.Dask) (*SchedulerStatus, error) {
+	return c.status, nil
+}
+
+var _ = Describe("Dask idle teardown", func() {
+	now := time.Date(2021, time.June, 2, 12, 0, 0, 0, time.UTC)
+
+	newReconciler := func(instance *operatorsv2.Dask, status *SchedulerStatus) *DaskReconciler {
+		scheme := runtime.NewScheme()
+		Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+		return &DaskReconciler{
+			Client:   fake.NewFakeClientWithScheme(scheme, instance),
+			Log:      ctrl.Log.WithName("dask-idle"),
+			Scheme:   scheme,
+			Recorder: record.NewFakeRecorder(10),
+			Dask:     &fakeDaskClient{status: status},
+		}
+	}
+	newDask := func(policy operatorsv2.DaskIdlePolicy, idleSince time.Time) *operatorsv2.Dask {
+		since := metav1.NewTime(idleSince)
+		return &operatorsv2.Dask{
+			ObjectMeta: metav1.ObjectMeta{Name: "idle", Namespace: "default"},
+			Spec: operatorsv2.DaskSpec{
+				WorkerTemplate: operatorsv2.WorkerTemplate{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "worker", Image: "daskdev/dask"}}},
+				},
+				IdleTimeout: &metav1.Duration{Duration: time.Hour},
+				IdlePolicy:  policy,
+			},
+			Status: operatorsv2.DaskStatus{IdleSince: &since},
+		}
+	}
+
+	It("Should reset the idle time while a client is connected", func() {
+		instance := newDask(operatorsv2.IdleScaleToZero, now.Add(-2*time.Hour))
+		r := newReconciler(instance, &SchedulerStatus{Clients: 2})
+		deleted, err := r.tearDownIfIdle(context.Background(), instance, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(BeFalse())
+		Expect(instance.Status.IdleSince).To(BeNil())
+	})
+
+	It("Should scale the workers to zero past the idle timeout", func() {
+		instance := newDask(operatorsv2.IdleScaleToZero, now.Add(-2*time.Hour))
+		// The scheduler always counts its own fire-and-forget client
+		r := newReconciler(instance, &SchedulerStatus{Clients: 1})
+		deleted, err := r.tearDownIfIdle(context.Background(), instance, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(BeFalse())
+		Expect(instance.Annotations).To(HaveKey(operatorsv2.StoppedAnnotation))
+		Expect(instance.Status.Reason).To(ContainSubstring("since 2021-06-02T10:00:00Z"))
+		Expect(*generateWorkerDeployment(instance, &instance.EffectiveWorkerGroups()[0]).Spec.Replicas).To(Equal(int32(0)))
+	})
+
+	It("Should only record the idle time without an idle timeout", func() {
+		instance := newDask(operatorsv2.IdleDelete, now.Add(-2*time.Hour))
+		instance.Spec.IdleTimeout = nil
+		instance.Status.IdleSince = nil
+		r := newReconciler(instance, &SchedulerStatus{Clients: 1})
+		deleted, err := r.tearDownIfIdle(context.Background(), instance, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(BeFalse())
+		Expect(instance.Status.IdleSince.Time).To(Equal(now))
+		Expect(instance.Annotations).NotTo(HaveKey(operatorsv2.StoppedAnnotation))
+	})
+
+	It("Should delete the cluster past the idle timeout", func() {
+		instance := newDask(operatorsv2.IdleDelete, now.Add(-2*time.Hour))
+		r := newReconciler(instance, &SchedulerStatus{Clients: 1})
+		deleted, err := r.tearDownIfIdle(context.Background(), instance, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(BeTrue())
+		err = r.Get(context.Background(), client.ObjectKeyFromObject(instance), &operatorsv2.Dask{})
+		Expect(apierrs.IsNotFound(err)).To(BeTrue())
+	})
+})
+
+type fakeJupyterClient struct {
+	status    ServerStatus
+	notices   []string
+	notifyErr error
+	// notifyActivity is the activity a real server records for the notice
+	notifyActivity time.Time
+}
+
+func (c *fakeJupyterClient) Status(ctx context.Context, instance *operatorsv2.Jupyter) (*ServerStatus, error) {
+	return &c.status, nil
+}
+
+func (c *fakeJupyterClient) Notify(ctx context.Context, instance *operatorsv2.Jupyter, message string) error {
+	if c.notifyErr != nil {
+		return c.notifyErr
+	}
+	c.notices = append(c.notices, message)
+	if !c.notifyActivity.IsZero() {
+		c.status.LastActivity = c.notifyActivity
+	}
+	return nil
+}
+
+func (c *fakeJupyterClient) Dismiss(ctx context.Context, instance *operatorsv2.Jupyter) error {
+	c.notices = nil
+	return nil
+}
+
+var _ = Describe("Notebook disruptions", func() {
+	now := time.Date(2021, time.June, 2, 12, 0, 0, 0, time.UTC)
+
+	newReconciler := func(jupyter *fakeJupyterClient, grace *metav1.Duration) *JupyterReconciler {
+		return &JupyterReconciler{
+			Log:      ctrl.Log.WithName("disruptions"),
+			Recorder: record.NewFakeRecorder(10),
+			Config:   configv1alpha1.NotebookConfig{DisruptionGracePeriod: grace},
+			Jupyter:  jupyter,
+		}
+	}
+	newJupyter := func(phase operatorsv2.JupyterPhase) *operatorsv2.Jupyter {
+		return &operatorsv2.Jupyter{
+			ObjectMeta: metav1.ObjectMeta{Name: "busy", Namespace: "default"},
+			Status:     operatorsv2.JupyterStatus{Phase: phase},
+		}
+	}
+
+	It("Should warn the user and wait for the grace period", func() {
+		jupyter := &fakeJupyterClient{}
+		r := newReconciler(jupyter, &metav1.Duration{Duration: 10 * time.Minute})
+		instance := newJupyter(operatorsv2.JupyterRunning)
+
+		result := ctrl.Result{}
+		Expect(r.awaitDisruption(context.Background(), instance, operatorsv2.ActionCull, &result, now)).To(BeFalse())
+		Expect(jupyter.notices).To(ConsistOf(ContainSubstring("stopped at 2021-06-02T12:10:00Z")))
+		Expect(instance.Status.PendingAction.Action).To(Equal(operatorsv2.ActionCull))
+		Expect(result.RequeueAfter).To(Equal(10 * time.Minute))
+
+		// The user is only warned once
+		Expect(r.awaitDisruption(context.Background(), instance, operatorsv2.ActionCull, &result, now.Add(5*time.Minute))).To(BeFalse())
+		Expect(jupyter.notices).To(HaveLen(1))
+
+		Expect(r.awaitDisruption(context.Background(), instance, operatorsv2.ActionCull, &result, now.Add(10*time.Minute))).To(BeTrue())
+		Expect(jupyter.notices).To(BeEmpty())
+		Expect(instance.Status.PendingAction).To(BeNil())
+	})
+
+	It("Should keep trying to warn the user until the server can be reached", func() {
+		jupyter := &fakeJupyterClient{notifyErr: errors.New("connection refused")}
+		r := newReconciler(jupyter, &metav1.Duration{Duration: 10 * time.Minute})
+		instance := newJupyter(operatorsv2.JupyterRunning)
+
+		result := ctrl.Result{}
+		Expect(r.awaitDisruption(context.Background(), instance, operatorsv2.ActionStop, &result, now)).To(BeFalse())
+		Expect(instance.Status.PendingAction.Notified).To(BeFalse())
+		Expect(result.RequeueAfter).To(Equal(cullCheckPeriod))
+
+		// The grace period isn't extended by the failure
+		jupyter.notifyErr = nil
+		Expect(r.awaitDisruption(context.Background(), instance, operatorsv2.ActionStop, &result, now.Add(time.Minute))).To(BeFalse())
+		Expect(jupyter.notices).To(ConsistOf(ContainSubstring("stopped at 2021-06-02T12:10:00Z")))
+		Expect(instance.Status.PendingAction.Notified).To(BeTrue())
+	})
+
+	It("Should not count the warning as activity of the user", func() {
+		idleSince := now.Add(-2 * time.Hour)
+		jupyter := &fakeJupyterClient{
+			status:         ServerStatus{LastActivity: idleSince},
+			notifyActivity: now.Add(time.Second),
+		}
+		r := newReconciler(jupyter, &metav1.Duration{Duration: 10 * time.Minute})
+		instance := newJupyter(operatorsv2.JupyterRunning)
+
+		Expect(isIdle(r.serverStatus(context.Background(), instance), time.Hour, now)).To(BeTrue())
+		result := ctrl.Result{}
+		Expect(r.awaitDisruption(context.Background(), instance, operatorsv2.ActionCull, &result, now)).To(BeFalse())
+		Expect(jupyter.status.LastActivity).To(Equal(now.Add(time.Second)))
+
+		// The next poll still sees the user idle since before the warning
+		later := now.Add(time.Minute)
+		server := r.serverStatus(context.Background(), instance)
+		Expect(server.LastActivity).To(Equal(idleSince))
+		Expect(isIdle(server, time.Hour, later)).To(BeTrue())
+		Expect(instance.Status.LastActivity.Time).To(Equal(idleSince))
+
+		// Until the user comes back
+		jupyter.status.LastActivity = later
+		Expect(isIdle(r.serverStatus(context.Background(), instance), time.Hour, later)).To(BeFalse())
+		Expect(instance.Status.LastActivity.Time).To(Equal(later))
+	})
+
+	It("Should act at once on a notebook that isn't running", func() {
+		jupyter := &fakeJupyterClient{}
+		r := newReconciler(jupyter, &metav1.Duration{Duration: 10 * time.Minute})
+		result := ctrl.Result{}
+		Expect(r.awaitDisruption(context.Background(), newJupyter(operatorsv2.JupyterPending), operatorsv2.ActionStop, &result, now)).To(BeTrue())
+		Expect(jupyter.notices).To(BeEmpty())
+	})
+
+	It("Should act at once without a grace period", func() {
+		r := newReconciler(&fakeJupyterClient{}, nil)
+		result := ctrl.Result{}
+		Expect(r.awaitDisruption(context.Background(), newJupyter(operatorsv2.JupyterRunning), operatorsv2.ActionRestart, &result, now)).To(BeTrue())
+	})
+
+	It("Should withdraw the warning of an action no longer pending", func() {
+		jupyter := &fakeJupyterClient{}
+		r := newReconciler(jupyter, &metav1.Duration{Duration: 10 * time.Minute})
+		instance := newJupyter(operatorsv2.JupyterRunning)
+		result := ctrl.Result{}
+		r.awaitDisruption(context.Background(), instance, operatorsv2.ActionCull, &result, now)
+
+		r.dismissDisruption(context.Background(), instance)
+		Expect(jupyter.notices).To(BeEmpty())
+		Expect(instance.Status.PendingAction).To(BeNil())
+	})
+
+	It("Should only protect a notebook in use from node drains", func() {
+		Expect(inUse(&ServerStatus{Connections: 1, LastActivity: now.Add(-time.Hour)}, now)).To(BeTrue())
+		Expect(inUse(&ServerStatus{LastActivity: now.Add(-time.Minute)}, now)).To(BeTrue())
+		Expect(inUse(&ServerStatus{Kernels: 1, LastActivity: now.Add(-time.Hour)}, now)).To(BeFalse())
+		Expect(inUse(nil, now)).To(BeFalse())
+	})
+
+	It("Should not count a restart the user asked for as a spec change", func() {
+		instance := newJupyter(operatorsv2.JupyterRunning)
+		instance.Spec.Template.Spec.Containers = []corev1.Container{{Name: "busy", Image: "jupyter/minimal-notebook"}}
+		before := templateHash(&generateStatefulSet(instance, 1).Spec.Template)
+
+		instance.Annotations = map[string]string{operatorsv2.RestartedAtAnnotation: "now"}
+		Expect(templateHash(&generateStatefulSet(instance, 1).Spec.Template)).To(Equal(before))
+
+		instance.Spec.Template.Spec.Containers[0].Image = "jupyter/scipy-notebook"
+		Expect(templateHash(&generateStatefulSet(instance, 1).Spec.Template)).NotTo(Equal(before))
+	})
+})
+
+var _ = Describe("Notebook update policies", func() {
+	now := time.Date(2021, time.June, 2, 12, 0, 0, 0, time.UTC)
+
+	newReconciler := func() *JupyterReconciler {
+		return &JupyterReconciler{
+			Log:      ctrl.Log.WithName("updates"),
+			Recorder: record.NewFakeRecorder(10),
+		}
+	}
+	newJupyter := func(policy operatorsv2.UpdatePolicy, phase operatorsv2.JupyterPhase) *operatorsv2.Jupyter {
+		return &operatorsv2.Jupyter{
+			ObjectMeta: metav1.ObjectMeta{Name: "busy", Namespace: "default"},
+			Spec:       operatorsv2.JupyterSpec{UpdatePolicy: policy},
+			Status:     operatorsv2.JupyterStatus{Phase: phase},
+		}
+	}
+
+	It("Should apply a change at once by default", func() {
+		instance := newJupyter("", operatorsv2.JupyterRunning)
+		Expect(newReconciler().deferUpdate(instance, "new", &ServerStatus{}, &ctrl.Result{}, now)).To(BeFalse())
+		Expect(instance.Status.PendingTemplateHash).To(BeEmpty())
+	})
+
+	It("Should hold a change back until the notebook is stopped", func() {
+		r := newReconciler()
+		instance := newJupyter(operatorsv2.UpdateOnNextStart, operatorsv2.JupyterRunning)
+		Expect(r.deferUpdate(instance, "new", &ServerStatus{}, &ctrl.Result{}, now)).To(BeTrue())
+		Expect(instance.Status.PendingTemplateHash).To(Equal("new"))
+
+		instance.Status.Phase = operatorsv2.JupyterStopped
+		Expect(r.deferUpdate(instance, "new", nil, &ctrl.Result{}, now)).To(BeFalse())
+	})
+
+	It("Should apply a held back change when the user restarts the notebook", func() {
+		r := newReconciler()
+		instance := newJupyter(operatorsv2.UpdateOnNextStart, operatorsv2.JupyterRunning)
+		Expect(r.deferUpdate(instance, "new", &ServerStatus{}, &ctrl.Result{}, now)).To(BeTrue())
+
+		instance.Annotations = map[string]string{operatorsv2.RestartedAtAnnotation: "2021-06-02T12:00:00Z"}
+		Expect(r.deferUpdate(instance, "new", &ServerStatus{}, &ctrl.Result{}, now)).To(BeFalse())
+	})
+
+	It("Should hold a change back while a kernel runs", func() {
+		r := newReconciler()
+		instance := newJupyter(operatorsv2.UpdateOnIdle, operatorsv2.JupyterRunning)
+
+		result := ctrl.Result{}
+		Expect(r.deferUpdate(instance, "new", &ServerStatus{Kernels: 1}, &result, now)).To(BeTrue())
+		Expect(instance.Status.PendingTemplateHash).To(Equal("new"))
+		Expect(result.RequeueAfter).To(Equal(cullCheckPeriod))
+
+		Expect(r.deferUpdate(instance, "new", &ServerStatus{}, &result, now)).To(BeFalse())
+	})
+
+	It("Should not hold a change back for a server unreachable for long", func() {
+		r := newReconciler()
+		instance := newJupyter(operatorsv2.UpdateOnIdle, operatorsv2.JupyterRunning)
+		lastActivity := metav1.NewTime(now.Add(-time.Minute))
+		instance.Status.LastActivity = &lastActivity
+		Expect(r.deferUpdate(instance, "new", nil, &ctrl.Result{}, now)).To(BeTrue())
+
+		Expect(r.deferUpdate(instance, "new", nil, &ctrl.Result{}, now.Add(time.Hour))).To(BeFalse())
+	})
+
+	It("Should hold a change back while a stop is pending", func() {
+		r := newReconciler()
+		r.Config.DisruptionGracePeriod = &metav1.Duration{Duration: 10 * time.Minute}
+		r.Jupyter = &fakeJupyterClient{}
+		instance := newJupyter(operatorsv2.UpdateOnIdle, operatorsv2.JupyterRunning)
+
+		result := ctrl.Result{}
+		Expect(r.awaitDisruption(context.Background(), instance, operatorsv2.ActionCull, &result, now)).To(BeFalse())
+		action := operatorsv2.ActionCull
+		Expect(r.holdUpdate(context.Background(), instance, "new", &ServerStatus{}, &action, &result, now)).To(BeTrue())
+		Expect(action).To(Equal(operatorsv2.ActionCull))
+		Expect(instance.Status.PendingAction.Action).To(Equal(operatorsv2.ActionCull))
+	})
+
+	It("Should warn the user before restarting for a change", func() {
+		r := newReconciler()
+		r.Config.DisruptionGracePeriod = &metav1.Duration{Duration: 10 * time.Minute}
+		r.Jupyter = &fakeJupyterClient{}
+		instance := newJupyter("", operatorsv2.JupyterRunning)
+
+		var action operatorsv2.NotebookAction
+		result := ctrl.Result{}
+		Expect(r.holdUpdate(context.Background(), instance, "new", &ServerStatus{}, &action, &result, now)).To(BeTrue())
+		Expect(action).To(Equal(operatorsv2.ActionRestart))
+
+		// The next reconcile finds no stop pending again
+		action = ""
+		Expect(r.holdUpdate(context.Background(), instance, "new", &ServerStatus{}, &action, &result, now.Add(10*time.Minute))).To(BeFalse())
+	})
+})
@@ -18,45 +18,334 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"reflect"
+	"time"
 
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
 	operatorsv2 "convect.ai/notebook-crd/api/v2"
 )
 
 // DaskReconciler reconciles a Dask object
 type DaskReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Config holds the controller-wide Dask settings
+	Config configv1alpha1.DaskConfig
+
+	// Dask polls the schedulers of clusters with an idle timeout, the
+	// dashboard API is used when unset.
+	Dask DaskClient
 }
 
 //+kubebuilder:rbac:groups=operators.convect.ai,resources=dasks,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=operators.convect.ai,resources=dasks/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=operators.convect.ai,resources=dasks/finalizers,verbs=update
+// +kubebuilder:rbac:groups=core,resources=services,verbs="*"
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs="*"
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs="*"
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs="*"
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs="*"
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
-// TODO(user): Modify the Reconcile function to compare the state specified by
-// the Dask object against the actual cluster state, and then
-// perform operations to make the cluster state reflect the state specified by
-// the user.
+// It runs the Dask scheduler as a Deployment behind a Service, exposing its
+// dashboard through an Ingress when configured, and the workers as one
+// Deployment per worker group pointed at that Service. TLS clusters get their
+// certificates from a per-cluster CA. Clusters with an idle timeout are torn
+// down once their scheduler has been idle for that long.
 //
 // For more details, check Reconcile and its Result here:
-// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.8.3/pkg/reconcile
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.7.2/pkg/reconcile
 func (r *DaskReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+	log := r.Log.WithValues("dask", req.NamespacedName)
+
+	instance := &operatorsv2.Dask{}
+	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
+		log.Error(err, "unable to fetch dask")
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, nil // Ignore not found error
+		}
+		return ctrl.Result{}, err
+	}
+
+	// Reconcile the TLS certificates
+	tlsSerial := ""
+	if instance.Spec.TLS {
+		serial, refused, err := r.reconcileTLS(ctx, instance, time.Now())
+		if err != nil {
+			log.Error(err, "unable to reconcile TLS certificates")
+			return ctrl.Result{}, err
+		}
+		if refused != "" {
+			// Leave the cluster alone rather than hand out certificates someone else controls
+			if instance.Status.Reason != refused {
+				r.Recorder.Eventf(instance, corev1.EventTypeWarning, "TLSRefused", "%s", refused)
+				instance.Status.Reason = refused
+				if err := r.Status().Update(ctx, instance); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+			return ctrl.Result{}, nil
+		}
+		tlsSerial = serial
+	} else if err := r.deleteTLS(ctx, instance); err != nil {
+		log.Error(err, "unable to delete TLS certificates")
+		return ctrl.Result{}, err
+	}
+
+	// Reconcile scheduler
+	scheduler := desiredSchedulerDeployment(instance, r.Config)
+	stampTLSSerial(&scheduler.Spec.Template, tlsSerial)
+	if err := r.applyOwned(ctx, instance, scheduler); err != nil {
+		log.Error(err, "unable to apply scheduler Deployment")
+		return ctrl.Result{}, err
+	}
+
+	// Reconcile scheduler service
+	if err := r.applyOwned(ctx, instance, generateSchedulerService(instance)); err != nil {
+		log.Error(err, "unable to apply scheduler service")
+		return ctrl.Result{}, err
+	}
+
+	// Reconcile dashboard ingress
+	if err := r.reconcileDashboardIngress(ctx, instance); err != nil {
+		log.Error(err, "unable to reconcile dashboard Ingress")
+		return ctrl.Result{}, err
+	}
+
+	// Reconcile a worker Deployment per group
+	oldStatus := instance.Status.DeepCopy()
+	instance.Status.WorkerReadyReplicas = 0
+	instance.Status.DesiredWorkers = 0
+	instance.Status.WorkerGroups = nil
+	workers := map[string]bool{}
+	groups := instance.EffectiveWorkerGroups()
+	for i := range groups {
+		group := &groups[i]
+		worker := desiredWorkerDeployment(instance, group, r.Config)
+		stampTLSSerial(&worker.Spec.Template, tlsSerial)
+		desiredWorkers := *worker.Spec.Replicas
+		if err := r.applyOwned(ctx, instance, worker); err != nil {
+			log.Error(err, "unable to apply worker Deployment", "group", group.Name)
+			return ctrl.Result{}, err
+		}
+		workers[worker.Name] = true
+		if err := r.reconcileWorkerPDB(ctx, instance, group); err != nil {
+			log.Error(err, "unable to reconcile worker PodDisruptionBudget", "group", group.Name)
+			return ctrl.Result{}, err
+		}
+
+		instance.Status.WorkerReadyReplicas += worker.Status.ReadyReplicas
+		instance.Status.DesiredWorkers += desiredWorkers
+		if group.Name != "" {
+			instance.Status.WorkerGroups = append(instance.Status.WorkerGroups, operatorsv2.DaskWorkerGroupStatus{
+				Name:          group.Name,
+				Replicas:      desiredWorkers,
+				ReadyReplicas: worker.Status.ReadyReplicas,
+			})
+		}
+	}
+	if err := r.deleteRemovedWorkers(ctx, instance, workers); err != nil {
+		log.Error(err, "unable to delete the Deployments of removed worker groups")
+		return ctrl.Result{}, err
+	}
+
+	// Update the status
+	instance.Status.SchedulerReadyReplicas = scheduler.Status.ReadyReplicas
+	instance.Status.RestartedAt = instance.Annotations[operatorsv2.RestartedAtAnnotation]
+	instance.Status.DashboardURL = daskPublicDashboardURL(instance, r.Config)
+	instance.Status.SchedulerAddress = daskSchedulerAddress(instance)
+	instance.Status.ClientSecretName = ""
+	if instance.Spec.TLS {
+		instance.Status.ClientSecretName = daskClientSecretName(instance.Name)
+	}
+	instance.Status.Creator = instance.Annotations[operatorsv2.CreatorAnnotation]
+
+	result := ctrl.Result{}
+	_, stopped := instance.Annotations[operatorsv2.StoppedAnnotation]
+	if !stopped {
+		instance.Status.Reason = ""
+	}
+	if !stopped && scheduler.Status.ReadyReplicas > 0 {
+		deleted, err := r.tearDownIfIdle(ctx, instance, time.Now())
+		if err != nil {
+			log.Error(err, "unable to tear down idle dask")
+			return ctrl.Result{}, err
+		}
+		if deleted {
+			return ctrl.Result{}, nil
+		}
+		requeueAfter(&result, cullCheckPeriod)
+	} else {
+		instance.Status.IdleSince = nil
+	}
+
+	// Protect the scheduler from node drains while the cluster is in use
+	_, stopped = instance.Annotations[operatorsv2.StoppedAnnotation]
+	if !stopped && scheduler.Status.ReadyReplicas > 0 && instance.Status.IdleSince == nil {
+		if err := r.applyOwned(ctx, instance, generateSchedulerPDB(instance)); err != nil {
+			log.Error(err, "unable to apply scheduler PodDisruptionBudget")
+			return ctrl.Result{}, err
+		}
+	} else if err := deleteIfOwned(ctx, r.Client, instance, daskSchedulerHost(instance), &policyv1beta1.PodDisruptionBudget{}); err != nil {
+		log.Error(err, "unable to delete scheduler PodDisruptionBudget")
+		return ctrl.Result{}, err
+	}
+
+	if !reflect.DeepEqual(oldStatus, &instance.Status) {
+		log.Info("Updating Status", "namespace", instance.Namespace, "name", instance.Name)
+		if err := r.Status().Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return result, nil
+}
 
-	// your logic here
+// tearDownIfIdle polls the scheduler, recording since when it is idle, and
+// applies the idle policy once the idle timeout, if any, has passed. It reports
+// whether the cluster was deleted.
+func (r *DaskReconciler) tearDownIfIdle(ctx context.Context, instance *operatorsv2.Dask, now time.Time) (bool, error) {
+	log := r.Log.WithValues("dask", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	dask := r.Dask
+	if dask == nil {
+		dask = NewDaskClient(r.Config)
+	}
+
+	status, err := dask.Status(ctx, instance)
+	if err != nil {
+		// The scheduler may be restarting, try again on the next poll
+		log.Info("Unable to get the scheduler status", "error", err.Error())
+		return false, nil
+	}
+
+	if status.Busy() {
+		instance.Status.IdleSince = nil
+		return false, nil
+	}
+	if instance.Status.IdleSince == nil {
+		idleSince := metav1.NewTime(now)
+		instance.Status.IdleSince = &idleSince
+	}
+	if instance.Spec.IdleTimeout == nil {
+		return false, nil
+	}
+	timeout := instance.Spec.IdleTimeout.Duration
+	if now.Sub(instance.Status.IdleSince.Time) <= timeout {
+		return false, nil
+	}
+
+	reason := fmt.Sprintf("No client connected nor task run since %s", instance.Status.IdleSince.UTC().Format(time.RFC3339))
+	if instance.Spec.IdlePolicy == operatorsv2.IdleDelete {
+		log.Info("Deleting idle dask", "namespace", instance.Namespace, "name", instance.Name)
+		r.Recorder.Event(instance, corev1.EventTypeNormal, "IdleDeleted", reason)
+		return true, client.IgnoreNotFound(r.Delete(ctx, instance))
+	}
+
+	log.Info("Scaling idle dask to zero", "namespace", instance.Namespace, "name", instance.Name)
+	reconciled := instance.Status
+	patch := client.MergeFrom(instance.DeepCopy())
+	if instance.Annotations == nil {
+		instance.Annotations = map[string]string{}
+	}
+	instance.Annotations[operatorsv2.StoppedAnnotation] = now.UTC().Format(time.RFC3339)
+	if err = r.Patch(ctx, instance, patch); err != nil {
+		return false, err
+	}
+	// The patch returns the stored status, keep the one being reconciled
+	instance.Status = reconciled
+	instance.Status.IdleSince = nil
+	instance.Status.Reason = reason
+	r.Recorder.Event(instance, corev1.EventTypeNormal, "IdleScaledToZero", reason)
+	return false, nil
+}
+
+// reconcileDashboardIngress creates or updates the Ingress of the scheduler
+// dashboard, or removes it when the dashboards are no longer exposed.
+func (r *DaskReconciler) reconcileDashboardIngress(ctx context.Context, instance *operatorsv2.Dask) error {
+	if r.Config.DashboardIngress != nil {
+		return r.applyOwned(ctx, instance, generateDashboardIngress(instance, r.Config))
+	}
+
+	return deleteIfOwned(ctx, r.Client, instance, instance.Name+"-dashboard", &networkingv1.Ingress{})
+}
+
+// deleteRemovedWorkers deletes the worker Deployments of the cluster but the
+// given ones, left behind by removed worker groups.
+func (r *DaskReconciler) deleteRemovedWorkers(ctx context.Context, instance *operatorsv2.Dask, keep map[string]bool) error {
+	deployments := &appsv1.DeploymentList{}
+	if err := r.List(ctx, deployments, client.InNamespace(instance.Namespace), client.MatchingLabels(daskLabels(instance.Name, "worker"))); err != nil {
+		return err
+	}
+	for i := range deployments.Items {
+		deploy := &deployments.Items[i]
+		if keep[deploy.Name] || !metav1.IsControlledBy(deploy, instance) {
+			continue
+		}
+		if err := r.Delete(ctx, deploy); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		if err := deleteIfOwned(ctx, r.Client, instance, deploy.Name, &policyv1beta1.PodDisruptionBudget{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileWorkerPDB applies the PodDisruptionBudget of a worker group, or
+// removes it when spec.workerMinAvailable is unset.
+func (r *DaskReconciler) reconcileWorkerPDB(ctx context.Context, instance *operatorsv2.Dask, group *operatorsv2.DaskWorkerGroup) error {
+	if instance.Spec.WorkerMinAvailable != nil {
+		return r.applyOwned(ctx, instance, generateWorkerPDB(instance, group))
+	}
+	return deleteIfOwned(ctx, r.Client, instance, workerDeploymentName(instance, group), &policyv1beta1.PodDisruptionBudget{})
+}
+
+// createOwned makes the Dask own obj and creates it.
+func (r *DaskReconciler) createOwned(ctx context.Context, instance *operatorsv2.Dask, obj client.Object) error {
+	if err := ctrl.SetControllerReference(instance, obj, r.Scheme); err != nil {
+		return err
+	}
+	return r.Create(ctx, obj)
+}
 
-	return ctrl.Result{}, nil
+// applyOwned makes the Dask own obj and server-side applies it.
+func (r *DaskReconciler) applyOwned(ctx context.Context, instance *operatorsv2.Dask, obj client.Object) error {
+	if err := ctrl.SetControllerReference(instance, obj, r.Scheme); err != nil {
+		return err
+	}
+	return applyObject(ctx, r.Client, obj)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *DaskReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.Config.MaxConcurrentReconciles}).
 		For(&operatorsv2.Dask{}).
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Service{}).
+		Owns(&networkingv1.Ingress{}).
+		Owns(&corev1.Secret{}).
+		Owns(&policyv1beta1.PodDisruptionBudget{}).
 		Complete(r)
 }
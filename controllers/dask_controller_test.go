@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("Dask controller", func() {
+	// Define utility constants for object names and testing timeouts/durations and intervals.
+	const (
+		Name      = "test-dask"
+		Namespace = "default"
+		timeout   = time.Second * 10
+		interval  = time.Millisecond * 250
+	)
+
+	Context("When validating the dask controller", func() {
+		It("Should create the scheduler and the workers", func() {
+			By("By creating a new dask cluster")
+			ctx := context.Background()
+			numWorkers := int32(3)
+			dask := &operatorsv2.Dask{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      Name,
+					Namespace: Namespace,
+				},
+				Spec: operatorsv2.DaskSpec{
+					NumWorkers: &numWorkers,
+					SchedulerTemplate: operatorsv2.WorkerTemplate{
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{
+								Name:  "scheduler",
+								Image: "daskdev/dask",
+							}},
+						},
+					},
+					WorkerTemplate: operatorsv2.WorkerTemplate{
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{
+								Name:  "worker",
+								Image: "daskdev/dask",
+							}},
+						},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, dask)).Should(Succeed())
+
+			By("By checking that the scheduler has a deployment and a service")
+			schedulerLookupKey := types.NamespacedName{Name: Name + "-scheduler", Namespace: Namespace}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, schedulerLookupKey, &appsv1.Deployment{})
+			}, timeout, interval).Should(Succeed())
+			Eventually(func() error {
+				return k8sClient.Get(ctx, schedulerLookupKey, &v1.Service{})
+			}, timeout, interval).Should(Succeed())
+
+			By("By checking that the scheduler isn't protected from node drains before it is ready")
+			Consistently(func() error {
+				return k8sClient.Get(ctx, schedulerLookupKey, &policyv1beta1.PodDisruptionBudget{})
+			}, time.Second, interval).ShouldNot(Succeed())
+
+			By("By checking that the workers point at the scheduler")
+			worker := &appsv1.Deployment{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, types.NamespacedName{Name: Name + "-worker", Namespace: Namespace}, worker)
+			}, timeout, interval).Should(Succeed())
+			Expect(*worker.Spec.Replicas).To(Equal(numWorkers))
+			Expect(worker.Spec.Template.Spec.Containers[0].Args).To(ContainElement("tcp://test-dask-scheduler.default.svc:8786"))
+		})
+
+		It("Should restart the workers on demand", func() {
+			ctx := context.Background()
+			daskLookupKey := types.NamespacedName{Name: Name, Namespace: Namespace}
+
+			By("By annotating the dask cluster with restartedAt")
+			dask := &operatorsv2.Dask{}
+			Expect(k8sClient.Get(ctx, daskLookupKey, dask)).Should(Succeed())
+			dask.Annotations = map[string]string{
+				operatorsv2.RestartedAtAnnotation: "2021-06-01T10:00:00Z",
+			}
+			Expect(k8sClient.Update(ctx, dask)).Should(Succeed())
+
+			By("By checking that the worker pod template is stamped")
+			Eventually(func() string {
+				worker := &appsv1.Deployment{}
+				if err := k8sClient.Get(ctx, types.NamespacedName{Name: Name + "-worker", Namespace: Namespace}, worker); err != nil {
+					return ""
+				}
+				return worker.Spec.Template.Annotations[operatorsv2.RestartedAtAnnotation]
+			}, timeout, interval).Should(Equal("2021-06-01T10:00:00Z"))
+
+			By("By checking that the restart is recorded in status")
+			Eventually(func() string {
+				if err := k8sClient.Get(ctx, daskLookupKey, dask); err != nil {
+					return ""
+				}
+				return dask.Status.RestartedAt
+			}, timeout, interval).Should(Equal("2021-06-01T10:00:00Z"))
+		})
+
+		It("Should run a Deployment per worker group", func() {
+			By("By creating a dask cluster with two worker groups")
+			ctx := context.Background()
+			const groupsName = "test-dask-groups"
+			highmem := int32(2)
+			workerSpec := v1.PodSpec{Containers: []v1.Container{{Name: "worker", Image: "daskdev/dask"}}}
+			dask := &operatorsv2.Dask{
+				ObjectMeta: metav1.ObjectMeta{Name: groupsName, Namespace: Namespace},
+				Spec: operatorsv2.DaskSpec{
+					SchedulerTemplate: operatorsv2.WorkerTemplate{
+						Spec: v1.PodSpec{Containers: []v1.Container{{Name: "scheduler", Image: "daskdev/dask"}}},
+					},
+					WorkerGroups: []operatorsv2.DaskWorkerGroup{
+						{
+							Name:      "highmem",
+							Replicas:  &highmem,
+							Template:  operatorsv2.WorkerTemplate{Spec: workerSpec},
+							Resources: map[string]string{"highmem": "1"},
+						},
+						{Name: "spot", Template: operatorsv2.WorkerTemplate{Spec: workerSpec}},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, dask)).Should(Succeed())
+
+			By("By checking each group has its Deployment")
+			highmemKey := types.NamespacedName{Name: groupsName + "-worker-highmem", Namespace: Namespace}
+			worker := &appsv1.Deployment{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, highmemKey, worker)
+			}, timeout, interval).Should(Succeed())
+			Expect(*worker.Spec.Replicas).To(Equal(highmem))
+			Expect(worker.Spec.Template.Spec.Containers[0].Args).To(ContainElements("--resources", "highmem=1"))
+			spotKey := types.NamespacedName{Name: groupsName + "-worker-spot", Namespace: Namespace}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, spotKey, &appsv1.Deployment{})
+			}, timeout, interval).Should(Succeed())
+
+			By("By checking the status lists the groups")
+			daskLookupKey := types.NamespacedName{Name: groupsName, Namespace: Namespace}
+			Eventually(func() int {
+				if err := k8sClient.Get(ctx, daskLookupKey, dask); err != nil {
+					return 0
+				}
+				return len(dask.Status.WorkerGroups)
+			}, timeout, interval).Should(Equal(2))
+			Expect(dask.Status.DesiredWorkers).To(Equal(int32(3)))
+
+			By("By removing the spot group")
+			dask.Spec.WorkerGroups = dask.Spec.WorkerGroups[:1]
+			Expect(k8sClient.Update(ctx, dask)).Should(Succeed())
+			Eventually(func() bool {
+				return apierrs.IsNotFound(k8sClient.Get(ctx, spotKey, &appsv1.Deployment{}))
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,302 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+const (
+	// daskConfigPath is where Dask reads its system-wide configuration from
+	daskConfigPath = "/etc/dask"
+
+	// daskTLSSerialAnnotation rolls the scheduler and worker pods when their
+	// certificate is renewed, as Dask only reads it at startup
+	daskTLSSerialAnnotation = "operators.convect.ai/tlsSerial"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+	// certRenewBefore is how long before expiry certificates are renewed
+	certRenewBefore = 30 * 24 * time.Hour
+)
+
+// daskCASecretName returns the Secret holding the CA of a Dask cluster
+func daskCASecretName(instance *operatorsv2.Dask) string {
+	return instance.Name + "-tls-ca"
+}
+
+// daskTLSSecretName returns the Secret mounted by the scheduler and workers
+// of a Dask cluster
+func daskTLSSecretName(instance *operatorsv2.Dask) string {
+	return instance.Name + "-tls"
+}
+
+// daskClientSecretName returns the Secret mounted by the clients of a Dask cluster
+func daskClientSecretName(daskName string) string {
+	return daskName + "-tls-client"
+}
+
+// mountDaskConfig mounts a Secret holding a dask.yaml and its certificates
+// as the Dask configuration of the first container of a pod.
+func mountDaskConfig(podSpec *corev1.PodSpec, secretName string, optional bool) {
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "dask-config",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: secretName, Optional: &optional},
+		},
+	})
+	container := &podSpec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "dask-config",
+		MountPath: daskConfigPath,
+		ReadOnly:  true,
+	})
+}
+
+// stampTLSSerial records the serial number of the certificate of a TLS Dask
+// cluster in a pod template, so that the pods roll when it is renewed.
+func stampTLSSerial(template *corev1.PodTemplateSpec, serial string) {
+	if serial == "" {
+		return
+	}
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[daskTLSSerialAnnotation] = serial
+}
+
+// daskTLSConfig returns the dask.yaml configuring the given roles to use the
+// certificate mounted next to it.
+func daskTLSConfig(schedulerAddress string, roles ...string) ([]byte, error) {
+	certs := map[string]interface{}{}
+	for _, role := range roles {
+		certs[role] = map[string]string{
+			"cert": daskConfigPath + "/" + corev1.TLSCertKey,
+			"key":  daskConfigPath + "/" + corev1.TLSPrivateKeyKey,
+		}
+	}
+	certs["ca-file"] = daskConfigPath + "/ca.crt"
+
+	config := map[string]interface{}{
+		"distributed": map[string]interface{}{
+			"comm": map[string]interface{}{
+				"require-encryption": true,
+				"tls":                certs,
+			},
+		},
+	}
+	if schedulerAddress != "" {
+		config["scheduler-address"] = schedulerAddress
+	}
+	return yaml.Marshal(config)
+}
+
+// reconcileTLS creates the CA of a TLS Dask cluster and keeps the server and
+// client certificates it signs valid. It returns the serial number of the
+// server certificate, or why it refused to when one of the Secrets exists
+// and isn't owned by the cluster.
+func (r *DaskReconciler) reconcileTLS(ctx context.Context, instance *operatorsv2.Dask, now time.Time) (string, string, error) {
+	caSecret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: daskCASecretName(instance), Namespace: instance.Namespace}, caSecret)
+	if apierrs.IsNotFound(err) {
+		certPEM, keyPEM, err := generateCertificate(nil, nil, instance.Name+"-ca", nil, now, caValidity)
+		if err != nil {
+			return "", "", err
+		}
+		caSecret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: daskCASecretName(instance), Namespace: instance.Namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       map[string][]byte{corev1.TLSCertKey: certPEM, corev1.TLSPrivateKeyKey: keyPEM},
+		}
+		if err = r.createOwned(ctx, instance, caSecret); err != nil {
+			return "", "", err
+		}
+	} else if err != nil {
+		return "", "", err
+	} else if !metav1.IsControlledBy(caSecret, instance) {
+		return "", secretRefused(caSecret.Name), nil
+	}
+
+	ca, caKey, err := parseKeyPair(caSecret.Data[corev1.TLSCertKey], caSecret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid CA in secret %s: %w", caSecret.Name, err)
+	}
+
+	host := daskSchedulerHost(instance)
+	dnsNames := []string{
+		host,
+		host + "." + instance.Namespace,
+		host + "." + instance.Namespace + ".svc",
+		host + "." + instance.Namespace + ".svc.cluster.local",
+	}
+	serverConfig, err := daskTLSConfig("", "scheduler", "worker", "client")
+	if err != nil {
+		return "", "", err
+	}
+	serial, refused, err := r.reconcileCertificate(ctx, instance, daskTLSSecretName(instance), ca, caKey, dnsNames, serverConfig, now)
+	if err != nil || refused != "" {
+		return "", refused, err
+	}
+
+	clientConfig, err := daskTLSConfig(daskSchedulerAddress(instance), "client")
+	if err != nil {
+		return "", "", err
+	}
+	if _, refused, err = r.reconcileCertificate(ctx, instance, daskClientSecretName(instance.Name), ca, caKey, nil, clientConfig, now); err != nil || refused != "" {
+		return "", refused, err
+	}
+	return serial, "", nil
+}
+
+// reconcileCertificate issues the certificate of a Secret holding a Dask
+// configuration when it is missing, about to expire or not signed by ca.
+// A Secret of that name the cluster doesn't own is left alone.
+func (r *DaskReconciler) reconcileCertificate(ctx context.Context, instance *operatorsv2.Dask, name string, ca *x509.Certificate, caKey crypto.Signer, dnsNames []string, config []byte, now time.Time) (string, string, error) {
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, secret)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return "", "", err
+	}
+	exists := err == nil
+
+	if exists {
+		if !metav1.IsControlledBy(secret, instance) {
+			return "", secretRefused(name), nil
+		}
+		cert, _, err := parseKeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+		if err == nil && cert.CheckSignatureFrom(ca) == nil && now.Add(certRenewBefore).Before(cert.NotAfter) {
+			return cert.SerialNumber.Text(16), "", nil
+		}
+	}
+
+	certPEM, keyPEM, err := generateCertificate(ca, caKey, name, dnsNames, now, certValidity)
+	if err != nil {
+		return "", "", err
+	}
+	cert, _, err := parseKeyPair(certPEM, keyPEM)
+	if err != nil {
+		return "", "", err
+	}
+	secret.Name = name
+	secret.Namespace = instance.Namespace
+	secret.Type = corev1.SecretTypeTLS
+	secret.Data = map[string][]byte{
+		"ca.crt":                pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}),
+		corev1.TLSCertKey:       certPEM,
+		corev1.TLSPrivateKeyKey: keyPEM,
+		"dask.yaml":             config,
+	}
+	if exists {
+		return cert.SerialNumber.Text(16), "", r.Update(ctx, secret)
+	}
+	return cert.SerialNumber.Text(16), "", r.createOwned(ctx, instance, secret)
+}
+
+// secretRefused explains why the TLS Secrets of a cluster weren't reconciled.
+func secretRefused(name string) string {
+	return fmt.Sprintf("Secret %s already exists and isn't owned by the cluster", name)
+}
+
+// deleteTLS removes the Secrets of a cluster whose TLS was disabled, so that
+// its notebooks stop loading the client configuration.
+func (r *DaskReconciler) deleteTLS(ctx context.Context, instance *operatorsv2.Dask) error {
+	for _, name := range []string{daskClientSecretName(instance.Name), daskTLSSecretName(instance), daskCASecretName(instance)} {
+		if err := deleteIfOwned(ctx, r.Client, instance, name, &corev1.Secret{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateCertificate returns a PEM-encoded certificate and ECDSA key. The
+// certificate is a self-signed CA when ca is nil, a leaf signed by ca
+// usable by servers and clients otherwise.
+func generateCertificate(ca *x509.Certificate, caKey crypto.Signer, commonName string, dnsNames []string, now time.Time, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		ca, caKey = template, key
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// parseKeyPair decodes a PEM-encoded certificate and ECDSA key.
+func parseKeyPair(certPEM, keyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("missing PEM data")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("Dask TLS", func() {
+	now := time.Date(2021, time.June, 2, 12, 0, 0, 0, time.UTC)
+
+	var (
+		r        *DaskReconciler
+		instance *operatorsv2.Dask
+	)
+
+	BeforeEach(func() {
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+		instance = &operatorsv2.Dask{
+			ObjectMeta: metav1.ObjectMeta{Name: "secure", Namespace: "default", UID: "secure-uid"},
+			Spec:       operatorsv2.DaskSpec{TLS: true},
+		}
+		r = &DaskReconciler{
+			Client: fake.NewFakeClientWithScheme(scheme, instance),
+			Log:    ctrl.Log.WithName("dask-tls"),
+			Scheme: scheme,
+		}
+	})
+
+	getSecret := func(name string) *corev1.Secret {
+		secret := &corev1.Secret{}
+		Expect(r.Get(context.Background(), types.NamespacedName{Name: name, Namespace: "default"}, secret)).To(Succeed())
+		return secret
+	}
+
+	It("Should issue the scheduler certificate from the cluster CA", func() {
+		serial, refused, err := r.reconcileTLS(context.Background(), instance, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(refused).To(BeEmpty())
+
+		ca, _, err := parseKeyPair(getSecret("secure-tls-ca").Data["tls.crt"], getSecret("secure-tls-ca").Data["tls.key"])
+		Expect(err).NotTo(HaveOccurred())
+		server := getSecret("secure-tls")
+		cert, _, err := parseKeyPair(server.Data["tls.crt"], server.Data["tls.key"])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.SerialNumber.Text(16)).To(Equal(serial))
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		_, err = cert.Verify(x509.VerifyOptions{
+			DNSName:     "secure-scheduler.default.svc",
+			Roots:       roots,
+			CurrentTime: now,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(server.Data["dask.yaml"])).To(ContainSubstring("require-encryption: true"))
+	})
+
+	It("Should give clients the TLS scheduler address", func() {
+		_, _, err := r.reconcileTLS(context.Background(), instance, now)
+		Expect(err).NotTo(HaveOccurred())
+		config := string(getSecret("secure-tls-client").Data["dask.yaml"])
+		Expect(config).To(ContainSubstring("scheduler-address: tls://secure-scheduler.default.svc:8786"))
+	})
+
+	It("Should renew certificates about to expire", func() {
+		first, _, err := r.reconcileTLS(context.Background(), instance, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		again, _, err := r.reconcileTLS(context.Background(), instance, now.Add(24*time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(Equal(first))
+
+		renewed, _, err := r.reconcileTLS(context.Background(), instance, now.Add(certValidity-time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(renewed).NotTo(Equal(first))
+	})
+
+	It("Should leave alone a Secret it doesn't own", func() {
+		_, _, err := r.reconcileTLS(context.Background(), instance, now)
+		Expect(err).NotTo(HaveOccurred())
+		client := getSecret("secure-tls-client")
+		client.OwnerReferences = nil
+		client.Data = map[string][]byte{"dask.yaml": []byte("foreign")}
+		Expect(r.Update(context.Background(), client)).To(Succeed())
+
+		_, refused, err := r.reconcileTLS(context.Background(), instance, now.Add(certValidity-time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(refused).To(ContainSubstring("secure-tls-client"))
+		Expect(string(getSecret("secure-tls-client").Data["dask.yaml"])).To(Equal("foreign"))
+	})
+
+	It("Should mount the client configuration only for TLS clusters", func() {
+		notebook := &operatorsv2.Jupyter{
+			ObjectMeta: metav1.ObjectMeta{Name: "nb", Namespace: "default"},
+			Spec: operatorsv2.JupyterSpec{
+				Template: operatorsv2.JupyterTemplate{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nb"}}}},
+				DaskRef:  &corev1.LocalObjectReference{Name: "secure"},
+			},
+		}
+		ss := desiredStatefulSet(notebook, 1, "", false, configv1alpha1.NotebookConfig{})
+		Expect(ss.Spec.Template.Spec.Volumes).To(BeEmpty())
+
+		ss = desiredStatefulSet(notebook, 1, "", true, configv1alpha1.NotebookConfig{})
+		Expect(ss.Spec.Template.Spec.Volumes).To(HaveLen(1))
+		Expect(ss.Spec.Template.Spec.Volumes[0].Secret.SecretName).To(Equal("secure-tls-client"))
+	})
+})
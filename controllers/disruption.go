@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// templateHashAnnotation records on a StatefulSet the hash of the pod
+// template it was applied with
+const templateHashAnnotation = "operators.convect.ai/templateHash"
+
+// templateHash hashes a pod template, leaving out the restarts the user asked
+// for since those don't need a warning.
+func templateHash(template *corev1.PodTemplateSpec) string {
+	t := template.DeepCopy()
+	delete(t.Annotations, operatorsv2.RestartedAtAnnotation)
+	// A PodTemplateSpec always marshals
+	data, _ := json.Marshal(t)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// disruptionMessage tells the user of a notebook what is about to happen to it.
+func disruptionMessage(action operatorsv2.NotebookAction, notBefore time.Time) string {
+	at := notBefore.UTC().Format(time.RFC3339)
+	switch action {
+	case operatorsv2.ActionCull:
+		return fmt.Sprintf("This notebook has been idle and will be stopped at %s. Use it to keep it running.", at)
+	case operatorsv2.ActionStop:
+		return fmt.Sprintf("This notebook will be stopped at %s by its schedule. Save your work.", at)
+	default:
+		return fmt.Sprintf("This notebook will restart at %s to apply a change of its settings. Save your work.", at)
+	}
+}
+
+// deferUpdate reports whether the update policy of a running notebook holds
+// back the template hashed as hash, recording it as pending. server is the
+// status the notebook server reported, nil when it couldn't be reached. A
+// restart the user asks for applies the template at once.
+func (r *JupyterReconciler) deferUpdate(instance *operatorsv2.Jupyter, hash string, server *ServerStatus, result *ctrl.Result, now time.Time) bool {
+	if instance.Status.Phase != operatorsv2.JupyterRunning {
+		return false
+	}
+	if instance.Annotations[operatorsv2.RestartedAtAnnotation] != instance.Status.RestartedAt {
+		return false
+	}
+	var until string
+	switch instance.Spec.UpdatePolicy {
+	case operatorsv2.UpdateOnIdle:
+		if server == nil {
+			// Don't hold the change forever for a server that can't be reached
+			if last := instance.Status.LastActivity; last == nil || now.Sub(last.Time) > drainIdleTime {
+				return false
+			}
+		} else if server.Connections == 0 && server.Kernels == 0 {
+			return false
+		}
+		// Poll the server until nobody works on it anymore
+		requeueAfter(result, cullCheckPeriod)
+		until = "idle"
+	case operatorsv2.UpdateOnNextStart:
+		until = "stopped"
+	default:
+		return false
+	}
+
+	if instance.Status.PendingTemplateHash != hash {
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "UpdateDeferred",
+			"Holding back the template change until the notebook is %s", until)
+		instance.Status.PendingTemplateHash = hash
+	}
+	return true
+}
+
+// holdUpdate reports whether the template hashed as hash is held back from a
+// running notebook. action is the stop pending for the notebook, if any, it
+// becomes a restart when the change is due.
+func (r *JupyterReconciler) holdUpdate(ctx context.Context, instance *operatorsv2.Jupyter, hash string, server *ServerStatus, action *operatorsv2.NotebookAction, result *ctrl.Result, now time.Time) bool {
+	if r.deferUpdate(instance, hash, server, result, now) {
+		return true
+	}
+	if *action != "" {
+		// The pending stop applies the change, without a restart of its own
+		return true
+	}
+	*action = operatorsv2.ActionRestart
+	return !r.awaitDisruption(ctx, instance, *action, result, now)
+}
+
+// awaitDisruption warns the user of a running notebook that action is about
+// to be taken and reports whether its grace period is over. The action is due
+// at once when no grace period is configured or the notebook isn't running.
+func (r *JupyterReconciler) awaitDisruption(ctx context.Context, instance *operatorsv2.Jupyter, action operatorsv2.NotebookAction, result *ctrl.Result, now time.Time) bool {
+	log := r.Log.WithValues("jupyter", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	grace := r.Config.DisruptionGracePeriod
+	if grace == nil || instance.Status.Phase != operatorsv2.JupyterRunning {
+		instance.Status.PendingAction = nil
+		return true
+	}
+
+	pending := instance.Status.PendingAction
+	if pending == nil || pending.Action != action {
+		notBefore := now.Add(grace.Duration)
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "DisruptionPending", "%s", disruptionMessage(action, notBefore))
+		pending = &operatorsv2.PendingAction{Action: action, NotBefore: metav1.NewTime(notBefore)}
+		instance.Status.PendingAction = pending
+	}
+
+	if now.Before(pending.NotBefore.Time) {
+		if !pending.Notified {
+			if err := r.jupyterClient().Notify(ctx, instance, disruptionMessage(action, pending.NotBefore.Time)); err != nil {
+				// The grace period still applies, the event is left to warn the user
+				log.Info("Unable to notify the notebook server", "error", err.Error())
+				requeueAfter(result, cullCheckPeriod)
+			} else {
+				pending.Notified = true
+				pending.NoticeActivity = r.noticeActivity(ctx, instance)
+			}
+		}
+		requeueAfter(result, pending.NotBefore.Sub(now))
+		return false
+	}
+
+	// Don't leave the notice behind for the next start
+	if err := r.jupyterClient().Dismiss(ctx, instance); err != nil {
+		log.Info("Unable to dismiss the notice", "error", err.Error())
+	}
+	instance.Status.PendingAction = nil
+	return true
+}
+
+// noticeActivity returns the activity the server reports once it shows a
+// warning, falling back to the operator's clock when it can't be reached.
+func (r *JupyterReconciler) noticeActivity(ctx context.Context, instance *operatorsv2.Jupyter) *metav1.Time {
+	log := r.Log.WithValues("jupyter", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	status, err := r.jupyterClient().Status(ctx, instance)
+	if err != nil {
+		log.Info("Unable to get the notebook server status", "error", err.Error())
+		now := metav1.Now()
+		return &now
+	}
+	activity := metav1.NewTime(status.LastActivity)
+	return &activity
+}
+
+// dismissDisruption withdraws the warning of an action that is no longer
+// pending, e.g. the user became active again before the notebook was culled.
+func (r *JupyterReconciler) dismissDisruption(ctx context.Context, instance *operatorsv2.Jupyter) {
+	log := r.Log.WithValues("jupyter", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	pending := instance.Status.PendingAction
+	if pending == nil {
+		return
+	}
+	if instance.Status.Phase == operatorsv2.JupyterRunning {
+		if err := r.jupyterClient().Dismiss(ctx, instance); err != nil {
+			log.Info("Unable to dismiss the notice", "error", err.Error())
+		}
+	}
+	r.Recorder.Eventf(instance, corev1.EventTypeNormal, "DisruptionCancelled", "%s is no longer pending", pending.Action)
+	instance.Status.PendingAction = nil
+}
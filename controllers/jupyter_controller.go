@@ -18,17 +18,31 @@ package controllers
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"time"
 
 	"github.com/go-logr/logr"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
 	operatorsv2 "convect.ai/notebook-crd/api/v2"
 )
 
@@ -38,6 +52,11 @@ type JupyterReconciler struct {
 	Log      logr.Logger
 	Scheme   *runtime.Scheme
 	Recorder record.EventRecorder
+
+	// Config holds the controller-wide notebook settings
+	Config configv1alpha1.NotebookConfig
+	// Jupyter reaches the notebook servers, NewJupyterClient(Client) when nil
+	Jupyter JupyterClient
 }
 
 //+kubebuilder:rbac:groups=operators.convect.ai,resources=jupyters,verbs=get;list;watch;create;update;patch;delete
@@ -46,6 +65,16 @@ type JupyterReconciler struct {
 // +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
 // +kubebuilder:rbac:groups=core,resources=services,verbs="*"
 // +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs="*"
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs="*"
+// +kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs="*"
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs="*"
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles,verbs=bind,resourceNames=view;edit
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs="*"
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs="*"
+// +kubebuilder:rbac:groups=operators.convect.ai,resources=notebookimages,verbs=get;list;watch
+// +kubebuilder:rbac:groups=operators.convect.ai,resources=dasks,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -69,74 +98,203 @@ func (r *JupyterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 
 	}
 
-	// Reconcile statefulset
-	ss := generateStatefulSet(instance)
+	// Reconcile the service account before the pod needs it
+	refused, err := r.reconcileServiceAccount(ctx, instance)
+	if err != nil {
+		log.Error(err, "unable to reconcile service account")
+		return ctrl.Result{}, err
+	}
+	if refused != "" {
+		// Leave the pod alone rather than run it under an account the notebook doesn't own
+		if instance.Status.Reason != refused {
+			r.Recorder.Eventf(instance, corev1.EventTypeWarning, "ServiceAccountRefused", "%s", refused)
+			instance.Status.Reason = refused
+			if err := r.Status().Update(ctx, instance); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
 
-	if err := ctrl.SetControllerReference(instance, ss, r.Scheme); err != nil {
+	// The token the operator authenticates to the server with
+	if err := r.reconcileToken(ctx, instance); err != nil {
+		log.Error(err, "unable to reconcile token")
 		return ctrl.Result{}, err
 	}
 
-	// Check if the statefulset already exists
-	foundStateful := &appsv1.StatefulSet{}
-	justCreate := false
-	err := r.Get(ctx, types.NamespacedName{Name: ss.Name, Namespace: ss.Namespace}, foundStateful)
+	// Reconcile the workspace before the pod mounts it
+	if instance.Spec.Workspace != nil {
+		created, err := r.reconcileWorkspace(ctx, instance)
+		if err != nil {
+			log.Error(err, "unable to reconcile workspace")
+			return ctrl.Result{}, err
+		}
+		if !created {
+			return ctrl.Result{RequeueAfter: snapshotPollPeriod}, nil
+		}
+	}
 
-	if err != nil && apierrs.IsNotFound(err) {
-		// Not found, create new
-		log.Info("Creating StatefulSet", "namespace", ss.Namespace, "name", ss.Name)
-		if err = r.Create(ctx, ss); err != nil {
-			log.Error(err, "unable to create StatefulSet")
+	oldStatus := instance.Status.DeepCopy()
+	now := time.Now()
+
+	// Resolve the catalog entry the notebook runs, if any
+	image, reason, err := r.resolveImage(ctx, instance)
+	if err != nil {
+		log.Error(err, "unable to resolve notebook image")
+		return ctrl.Result{}, err
+	}
+	if reason != "" && reason != instance.Status.Reason {
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, "ImageNotFound", "%s", reason)
+	}
+
+	// The Dask client configuration only exists for TLS clusters
+	daskTLS, err := r.daskTLS(ctx, instance)
+	if err != nil {
+		log.Error(err, "unable to fetch dask")
+		return ctrl.Result{}, err
+	}
+
+	// Work out whether the notebook should be running right now
+	replicas := int32(1)
+	result := ctrl.Result{}
+	if _, stopped := instance.Annotations[operatorsv2.StoppedAnnotation]; stopped {
+		replicas = 0
+	}
+	if name, ok := instance.Annotations[operatorsv2.SnapshotAnnotation]; ok {
+		snapshotting, err := snapshotInProgress(ctx, r.Client, instance.Namespace, name)
+		if err != nil {
 			return ctrl.Result{}, err
 		}
-		justCreate = true
+		if snapshotting {
+			replicas = 0
+		}
+	}
+	scheduledStop := false
+	if instance.Spec.Schedule != nil {
+		stopped, next, err := evaluateSchedule(instance.Spec.Schedule, now)
+		if err != nil {
+			// Retrying won't fix the expression, so only tell the user
+			log.Error(err, "invalid schedule")
+			r.Recorder.Eventf(instance, corev1.EventTypeWarning, "InvalidSchedule", "Ignoring schedule: %v", err)
+		} else {
+			scheduledStop = stopped
+			// Come back at the next boundary to flip the replicas
+			requeueAfter(&result, next.Sub(now))
+		}
+	}
 
-	} else if err != nil {
-		log.Error(err, "error getting StatefulSet")
+	// Poll the activity of the running server, which decides whether it is
+	// culled and whether it is protected from node drains
+	var server *ServerStatus
+	if replicas > 0 && instance.Status.Phase == operatorsv2.JupyterRunning {
+		server = r.serverStatus(ctx, instance)
+		requeueAfter(&result, cullCheckPeriod)
+	}
+
+	// Stops the user didn't ask for wait until the user was warned
+	var action operatorsv2.NotebookAction
+	if replicas > 0 && scheduledStop {
+		action = operatorsv2.ActionStop
+	} else if replicas > 0 && r.Config.CullIdleTime != nil && server != nil {
+		// Cull the notebook once its server has been idle for too long
+		if isIdle(server, r.Config.CullIdleTime.Duration, now) {
+			action = operatorsv2.ActionCull
+		}
+	}
+	if action != "" && r.awaitDisruption(ctx, instance, action, &result, now) {
+		if action == operatorsv2.ActionCull {
+			if err := r.cull(ctx, instance, now); err != nil {
+				log.Error(err, "unable to cull notebook")
+				return ctrl.Result{}, err
+			}
+		}
+		replicas = 0
+	}
+
+	// Reconcile statefulset
+	ss := desiredStatefulSet(instance, replicas, image, daskTLS, r.Config)
+
+	if err := ctrl.SetControllerReference(instance, ss, r.Scheme); err != nil {
 		return ctrl.Result{}, err
 	}
-	// Update the foundStateful object and write the result back if there are any changes
-	if !justCreate && copyStatefulSetFields(ss, foundStateful) {
-		log.Info("Updating StatefulSet", "namespace", ss.Namespace, "name", ss.Name)
-		if err = r.Update(ctx, foundStateful); err != nil {
-			log.Error(err, "unable to update StatefulSet")
+
+	// Hold back a spec change restarting the notebook until the user was warned.
+	// A stop still in its grace period keeps the notebook running and holds
+	// the change back too.
+	hold := false
+	current := &appsv1.StatefulSet{}
+	if replicas > 0 {
+		if err := r.Get(ctx, types.NamespacedName{Name: ss.Name, Namespace: ss.Namespace}, current); client.IgnoreNotFound(err) != nil {
 			return ctrl.Result{}, err
 		}
+		if hash := current.Annotations[templateHashAnnotation]; hash != "" && hash != ss.Annotations[templateHashAnnotation] {
+			hold = r.holdUpdate(ctx, instance, ss.Annotations[templateHashAnnotation], server, &action, &result, now)
+		}
+	}
+	instance.Status.PendingImage = ""
+	if !hold {
+		instance.Status.PendingTemplateHash = ""
+	} else if image := ss.Spec.Template.Spec.Containers[0].Image; image != current.Spec.Template.Spec.Containers[0].Image {
+		instance.Status.PendingImage = image
+	}
+	if action == "" {
+		r.dismissDisruption(ctx, instance)
+	}
+
+	// Apply only the fields we own, the result carries the current status
+	if hold {
+		ss = current
+	} else if err := applyObject(ctx, r.Client, ss); err != nil {
+		log.Error(err, "unable to apply StatefulSet")
+		return ctrl.Result{}, err
 	}
 
 	// Reconcile service
 	svc := generateService(instance)
 
-	foundService := &corev1.Service{}
-	justCreate = false
-	err = r.Get(ctx, types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}, foundService)
+	if err := ctrl.SetControllerReference(instance, svc, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
 
-	if err != nil && apierrs.IsNotFound(err) {
-		log.Info("Creating service", "namespace", svc.Namespace, "name", svc.Name)
-		if err = r.Create(ctx, svc); err != nil {
-			log.Error(err, "unable to create service")
-			return ctrl.Result{}, err
-		}
-		justCreate = true
-	} else if err != nil {
-		log.Error(err, "error getting service")
+	if err := applyObject(ctx, r.Client, svc); err != nil {
+		log.Error(err, "unable to apply service")
 		return ctrl.Result{}, err
 	}
 
-	// Update the service object if needed
-	if !justCreate && copyServiceFields(svc, foundService) {
-		log.Info("Updating service", "namespace", svc.Namespace, "name", svc.Name)
-		if err = r.Update(ctx, foundService); err != nil {
-			log.Error(err, "unable to update service")
+	// Reconcile network policy
+	if err := r.reconcileNetworkPolicy(ctx, instance); err != nil {
+		log.Error(err, "unable to reconcile network policy")
+		return ctrl.Result{}, err
+	}
+
+	// Protect the notebook from node drains while it is in use
+	if replicas > 0 && inUse(server, now) {
+		pdb := generateNotebookPDB(instance)
+		if err := ctrl.SetControllerReference(instance, pdb, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := applyObject(ctx, r.Client, pdb); err != nil {
+			log.Error(err, "unable to apply PodDisruptionBudget")
 			return ctrl.Result{}, err
 		}
+	} else if err := deleteIfOwned(ctx, r.Client, instance, instance.Name, &policyv1beta1.PodDisruptionBudget{}); err != nil {
+		log.Error(err, "unable to delete PodDisruptionBudget")
+		return ctrl.Result{}, err
 	}
 
 	// Update the status
-	// Update the ready replicas
-	if foundStateful.Status.ReadyReplicas != instance.Status.ReadyReplicas {
+	// Update the ready replicas, the phase, the handled restart, the URL, the creator and the image,
+	// the last activity was recorded when checking for culling
+	instance.Status.ReadyReplicas = ss.Status.ReadyReplicas
+	instance.Status.Phase = notebookPhase(replicas, ss.Status.ReadyReplicas)
+	instance.Status.RestartedAt = ss.Spec.Template.Annotations[operatorsv2.RestartedAtAnnotation]
+	instance.Status.URL = notebookURL(instance)
+	instance.Status.Creator = instance.Annotations[operatorsv2.CreatorAnnotation]
+	instance.Status.Image = ss.Spec.Template.Spec.Containers[0].Image
+	instance.Status.Reason = reason
+	if !reflect.DeepEqual(oldStatus, &instance.Status) {
 		log.Info("Updateing Status", "namespace", instance.Namespace, "name", instance.Name)
-		instance.Status.ReadyReplicas = foundStateful.Status.ReadyReplicas
-		if err = r.Status().Update(ctx, instance); err != nil {
+		if err := r.Status().Update(ctx, instance); err != nil {
 			return ctrl.Result{}, err
 		}
 	}
@@ -183,14 +341,384 @@ func (r *JupyterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		}
 	}
 
-	return ctrl.Result{}, nil
+	return result, nil
+}
+
+// jupyterClient returns the client reaching the notebook servers.
+func (r *JupyterReconciler) jupyterClient() JupyterClient {
+	if r.Jupyter == nil {
+		return NewJupyterClient(r.Client)
+	}
+	return r.Jupyter
+}
+
+// resolveImage returns the image of the catalog entry the notebook names, or
+// of the default entry when the notebook sets no image. It is empty when the
+// notebook doesn't use the catalog. A missing entry doesn't stop the notebook,
+// it keeps running its current image and the reason is returned.
+func (r *JupyterReconciler) resolveImage(ctx context.Context, instance *operatorsv2.Jupyter) (string, string, error) {
+	// The user is warned once about a deprecated entry
+	warned := instance.Status.DeprecatedImage
+	instance.Status.DeprecatedImage = ""
+
+	image, reason, err := catalogImage(ctx, r.Client, instance)
+	if err != nil {
+		return "", "", err
+	}
+	if reason != "" {
+		return instance.Status.Image, reason, nil
+	}
+	if image == nil {
+		return "", "", nil
+	}
+
+	if image.Spec.Deprecated {
+		if warned != image.Name {
+			r.Recorder.Eventf(instance, corev1.EventTypeWarning, "DeprecatedImage",
+				"NotebookImage %s is deprecated, switch to another image", image.Name)
+		}
+		instance.Status.DeprecatedImage = image.Name
+	}
+	return image.Spec.Image, "", nil
+}
+
+// serverStatus polls the notebook server and records the last activity of its
+// user. It is nil when the server can't be reached.
+func (r *JupyterReconciler) serverStatus(ctx context.Context, instance *operatorsv2.Jupyter) *ServerStatus {
+	log := r.Log.WithValues("jupyter", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	status, err := r.jupyterClient().Status(ctx, instance)
+	if err != nil {
+		// The server may be restarting, try again on the next poll
+		log.Info("Unable to get the notebook server status", "error", err.Error())
+		return nil
+	}
+
+	// Showing a warning counts as activity, keep the user's own
+	if pending := instance.Status.PendingAction; pending != nil && pending.NoticeActivity != nil && instance.Status.LastActivity != nil &&
+		!status.LastActivity.After(pending.NoticeActivity.Time) {
+		return &ServerStatus{
+			LastActivity: instance.Status.LastActivity.Time,
+			Connections:  status.Connections,
+			Kernels:      status.Kernels,
+		}
+	}
+
+	lastActivity := metav1.NewTime(status.LastActivity)
+	instance.Status.LastActivity = &lastActivity
+	return status
+}
+
+// cull stops an idle notebook.
+func (r *JupyterReconciler) cull(ctx context.Context, instance *operatorsv2.Jupyter, now time.Time) error {
+	log := r.Log.WithValues("jupyter", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	log.Info("Culling idle notebook", "namespace", instance.Namespace, "name", instance.Name)
+	// The patch returns the stored status, keep the one being reconciled
+	status := instance.Status.DeepCopy()
+	patch := client.MergeFrom(instance.DeepCopy())
+	if instance.Annotations == nil {
+		instance.Annotations = map[string]string{}
+	}
+	instance.Annotations[operatorsv2.StoppedAnnotation] = now.UTC().Format(time.RFC3339)
+	if err := r.Patch(ctx, instance, patch); err != nil {
+		return err
+	}
+	instance.Status = *status
+
+	r.Recorder.Eventf(instance, corev1.EventTypeNormal, "Culled",
+		"Stopped after being idle since %s", instance.Status.LastActivity.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// reconcileNetworkPolicy creates, updates or removes the NetworkPolicy
+// isolating the notebook depending on spec.isolation.
+func (r *JupyterReconciler) reconcileNetworkPolicy(ctx context.Context, instance *operatorsv2.Jupyter) error {
+	log := r.Log.WithValues("jupyter", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+
+	if instance.Spec.Isolation {
+		np := generateNetworkPolicy(instance, r.Config.NetworkPolicy)
+		if err := ctrl.SetControllerReference(instance, np, r.Scheme); err != nil {
+			return err
+		}
+		return applyObject(ctx, r.Client, np)
+	}
+
+	foundPolicy := &networkingv1.NetworkPolicy{}
+	err := r.Get(ctx, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, foundPolicy)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	// Only remove a policy we own, never one created by someone else
+	if metav1.IsControlledBy(foundPolicy, instance) {
+		log.Info("Deleting NetworkPolicy", "namespace", foundPolicy.Namespace, "name", foundPolicy.Name)
+		return client.IgnoreNotFound(r.Delete(ctx, foundPolicy))
+	}
+	return nil
+}
+
+// reconcileServiceAccount provisions the notebook's own ServiceAccount and
+// the RoleBinding granting it spec.serviceAccount.clusterRole, or removes
+// them once the notebook no longer asks for a dedicated account. Returns why
+// the account was refused, when the ClusterRole isn't allowed or the account
+// or binding belong to someone else.
+func (r *JupyterReconciler) reconcileServiceAccount(ctx context.Context, instance *operatorsv2.Jupyter) (string, error) {
+	log := r.Log.WithValues("jupyter", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+	key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+
+	foundAccount := &corev1.ServiceAccount{}
+	err := r.Get(ctx, key, foundAccount)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return "", err
+	}
+	accountFound := err == nil
+
+	foundBinding := &rbacv1.RoleBinding{}
+	err = r.Get(ctx, key, foundBinding)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return "", err
+	}
+	bindingFound := err == nil
+
+	if instance.Spec.ServiceAccount == nil {
+		if bindingFound && metav1.IsControlledBy(foundBinding, instance) {
+			log.Info("Deleting RoleBinding", "namespace", key.Namespace, "name", key.Name)
+			if err = r.Delete(ctx, foundBinding); client.IgnoreNotFound(err) != nil {
+				return "", err
+			}
+		}
+		if accountFound && metav1.IsControlledBy(foundAccount, instance) {
+			log.Info("Deleting ServiceAccount", "namespace", key.Namespace, "name", key.Name)
+			if err = r.Delete(ctx, foundAccount); client.IgnoreNotFound(err) != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	}
+
+	if accountFound && !metav1.IsControlledBy(foundAccount, instance) {
+		return fmt.Sprintf("ServiceAccount %s already exists and isn't owned by the notebook", key.Name), nil
+	}
+	if bindingFound && !metav1.IsControlledBy(foundBinding, instance) {
+		return fmt.Sprintf("RoleBinding %s already exists and isn't owned by the notebook", key.Name), nil
+	}
+	if role := instance.Spec.ServiceAccount.ClusterRole; !r.Config.AllowsClusterRole(role) {
+		// Revoke a role that is no longer allowed
+		if bindingFound {
+			log.Info("Deleting RoleBinding", "namespace", key.Namespace, "name", key.Name)
+			if err = r.Delete(ctx, foundBinding); client.IgnoreNotFound(err) != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("ClusterRole %s isn't allowed for notebook ServiceAccounts", role), nil
+	}
+
+	sa := generateServiceAccount(instance)
+	if err = ctrl.SetControllerReference(instance, sa, r.Scheme); err != nil {
+		return "", err
+	}
+	if err = applyObject(ctx, r.Client, sa); err != nil {
+		return "", err
+	}
+
+	rb := generateRoleBinding(instance)
+	if err = ctrl.SetControllerReference(instance, rb, r.Scheme); err != nil {
+		return "", err
+	}
+
+	// The role of a binding is immutable, so it has to be recreated when
+	// the notebook asks for another ClusterRole
+	if bindingFound && !reflect.DeepEqual(foundBinding.RoleRef, rb.RoleRef) {
+		log.Info("Deleting RoleBinding", "namespace", rb.Namespace, "name", rb.Name)
+		if err = r.Delete(ctx, foundBinding); client.IgnoreNotFound(err) != nil {
+			return "", err
+		}
+	}
+
+	if err = applyObject(ctx, r.Client, rb); apierrs.IsForbidden(err) {
+		// The operator can only bind the roles its own role grants bind on
+		return fmt.Sprintf("The operator isn't allowed to bind ClusterRole %s: %v", rb.RoleRef.Name, err), nil
+	}
+	return "", err
+}
+
+// reconcileToken creates the Secret holding the token of the notebook
+// server. It is never updated, so that the running server keeps its token.
+func (r *JupyterReconciler) reconcileToken(ctx context.Context, instance *operatorsv2.Jupyter) error {
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: notebookTokenName(instance), Namespace: instance.Namespace}, secret)
+	if err == nil || !apierrs.IsNotFound(err) {
+		return err
+	}
+
+	token := make([]byte, 24)
+	if _, err = rand.Read(token); err != nil {
+		return err
+	}
+	secret = generateTokenSecret(instance, hex.EncodeToString(token))
+	if err = ctrl.SetControllerReference(instance, secret, r.Scheme); err != nil {
+		return err
+	}
+	return r.Create(ctx, secret)
+}
+
+// reconcileWorkspace creates the workspace PersistentVolumeClaim, restoring
+// it from its snapshot once the snapshot is ready. Returns true if the claim
+// exists. Only the owner reference of the claim is updated, following its
+// reclaim policy, as its spec is immutable.
+func (r *JupyterReconciler) reconcileWorkspace(ctx context.Context, instance *operatorsv2.Jupyter) (bool, error) {
+	retain := instance.Spec.Workspace.ReclaimPolicy == operatorsv2.WorkspaceRetain
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, types.NamespacedName{Name: workspaceName(instance), Namespace: instance.Namespace}, pvc)
+	if err == nil {
+		return true, r.reclaimWorkspace(ctx, instance, pvc, retain)
+	}
+	if !apierrs.IsNotFound(err) {
+		return false, err
+	}
+
+	if name := instance.Spec.Workspace.FromSnapshot; name != "" {
+		snapshot := &operatorsv2.NotebookSnapshot{}
+		err = r.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, snapshot)
+		if err != nil && !apierrs.IsNotFound(err) {
+			return false, err
+		}
+		if err != nil || snapshot.Status.Phase != operatorsv2.SnapshotReady {
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, "WaitingForSnapshot", "Waiting for snapshot %s to be ready", name)
+			return false, nil
+		}
+	}
+
+	pvc = generateWorkspacePVC(instance)
+	if !retain {
+		if err = ctrl.SetControllerReference(instance, pvc, r.Scheme); err != nil {
+			return false, err
+		}
+	}
+	if err = r.Create(ctx, pvc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reclaimWorkspace makes the notebook own an existing workspace claim so that
+// it is deleted along with the notebook, or stop owning it to retain it. Only
+// the claims generated for a notebook of that name are taken over.
+func (r *JupyterReconciler) reclaimWorkspace(ctx context.Context, instance *operatorsv2.Jupyter, pvc *corev1.PersistentVolumeClaim, retain bool) error {
+	patch := client.MergeFrom(pvc.DeepCopy())
+	switch {
+	case retain && metav1.IsControlledBy(pvc, instance):
+		var refs []metav1.OwnerReference
+		for _, ref := range pvc.OwnerReferences {
+			if ref.UID != instance.UID {
+				refs = append(refs, ref)
+			}
+		}
+		pvc.OwnerReferences = refs
+	case !retain && metav1.GetControllerOf(pvc) == nil && pvc.Labels["notebook-name"] == instance.Name:
+		if err := ctrl.SetControllerReference(instance, pvc, r.Scheme); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	return r.Patch(ctx, pvc, patch)
+}
+
+// snapshotInProgress reports whether the named NotebookSnapshot still needs
+// the notebook stopped. A deleted or finished snapshot doesn't, even if it
+// didn't get to release the notebook.
+func snapshotInProgress(ctx context.Context, c client.Reader, namespace, name string) (bool, error) {
+	snapshot := &operatorsv2.NotebookSnapshot{}
+	if err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, snapshot); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	return snapshot.Status.Phase != operatorsv2.SnapshotReady && snapshot.Status.Phase != operatorsv2.SnapshotFailed, nil
+}
+
+// daskTLS reports whether the Dask cluster the notebook references has TLS
+// enabled. A missing cluster doesn't.
+func (r *JupyterReconciler) daskTLS(ctx context.Context, instance *operatorsv2.Jupyter) (bool, error) {
+	if instance.Spec.DaskRef == nil {
+		return false, nil
+	}
+	dask := &operatorsv2.Dask{}
+	if err := r.Get(ctx, types.NamespacedName{Name: instance.Spec.DaskRef.Name, Namespace: instance.Namespace}, dask); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	return dask.Spec.TLS, nil
+}
+
+// notebooksForDask maps a Dask cluster to the notebooks referencing it, which
+// mount its client configuration while its TLS is enabled.
+func (r *JupyterReconciler) notebooksForDask(obj client.Object) []reconcile.Request {
+	dask, ok := obj.(*operatorsv2.Dask)
+	if !ok {
+		return nil
+	}
+
+	notebooks := &operatorsv2.JupyterList{}
+	if err := r.List(context.Background(), notebooks, client.InNamespace(dask.Namespace)); err != nil {
+		r.Log.Error(err, "unable to list notebooks")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, notebook := range notebooks.Items {
+		if notebook.Spec.DaskRef != nil && notebook.Spec.DaskRef.Name == dask.Name {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: notebook.Name, Namespace: notebook.Namespace}})
+		}
+	}
+	return requests
+}
+
+// notebooksForImage maps a catalog entry to the notebooks naming it, and to
+// those without an image since the entry may have become, or stopped being,
+// the default one.
+func (r *JupyterReconciler) notebooksForImage(obj client.Object) []reconcile.Request {
+	image, ok := obj.(*operatorsv2.NotebookImage)
+	if !ok {
+		return nil
+	}
+
+	notebooks := &operatorsv2.JupyterList{}
+	if err := r.List(context.Background(), notebooks); err != nil {
+		r.Log.Error(err, "unable to list notebooks")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, notebook := range notebooks.Items {
+		if notebook.Spec.NotebookImage == image.Name || usesDefaultImage(&notebook) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: notebook.Name, Namespace: notebook.Namespace}})
+		}
+	}
+	return requests
+}
+
+// notebookForSnapshot maps a NotebookSnapshot to the notebook it stops or
+// restores, which the notebook has to react to.
+func notebookForSnapshot(obj client.Object) []reconcile.Request {
+	snapshot, ok := obj.(*operatorsv2.NotebookSnapshot)
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: snapshot.Spec.Notebook, Namespace: snapshot.Namespace}}}
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *JupyterReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.Config.MaxConcurrentReconciles}).
 		For(&operatorsv2.Jupyter{}).
 		Owns(&appsv1.StatefulSet{}).
 		Owns(&corev1.Service{}).
+		Owns(&networkingv1.NetworkPolicy{}).
+		Owns(&corev1.ServiceAccount{}).
+		Owns(&rbacv1.RoleBinding{}).
+		Owns(&corev1.PersistentVolumeClaim{}).
+		Owns(&policyv1beta1.PodDisruptionBudget{}).
+		Watches(&source.Kind{Type: &operatorsv2.NotebookSnapshot{}}, handler.EnqueueRequestsFromMapFunc(notebookForSnapshot)).
+		Watches(&source.Kind{Type: &operatorsv2.NotebookImage{}}, handler.EnqueueRequestsFromMapFunc(r.notebooksForImage)).
+		Watches(&source.Kind{Type: &operatorsv2.Dask{}}, handler.EnqueueRequestsFromMapFunc(r.notebooksForDask)).
 		Complete(r)
 }
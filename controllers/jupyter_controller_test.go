@@ -2,14 +2,26 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
 
 	operatorsv2 "convect.ai/notebook-crd/api/v2"
 )
@@ -72,5 +84,362 @@ var _ = Describe("Notebook controller", func() {
 				return true, nil
 			}, timeout, interval).Should(BeTrue())
 		})
+
+		It("Should isolate the notebook with a NetworkPolicy", func() {
+			By("By creating a new isolated notebook")
+			ctx := context.Background()
+			const isolatedName = "test-isolated-notebook"
+			notebook := &operatorsv2.Jupyter{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      isolatedName,
+					Namespace: Namespace,
+				},
+				Spec: operatorsv2.JupyterSpec{
+					Template: operatorsv2.JupyterTemplate{
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{
+								Name:  "busybox",
+								Image: "busybox",
+							}},
+						},
+					},
+					Isolation: true,
+					DaskRef:   &v1.LocalObjectReference{Name: "test-dask"},
+				},
+			}
+			Expect(k8sClient.Create(ctx, notebook)).Should(Succeed())
+
+			By("By checking that the notebook has a NetworkPolicy")
+			policyLookupKey := types.NamespacedName{Name: isolatedName, Namespace: Namespace}
+			policy := &networkingv1.NetworkPolicy{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, policyLookupKey, policy)
+			}, timeout, interval).Should(Succeed())
+			Expect(policy.Spec.PodSelector.MatchLabels).To(HaveKeyWithValue("statefulset", isolatedName))
+			Expect(policy.Spec.Egress).To(HaveLen(2))
+
+			By("By disabling isolation")
+			Expect(k8sClient.Get(ctx, policyLookupKey, notebook)).Should(Succeed())
+			notebook.Spec.Isolation = false
+			Expect(k8sClient.Update(ctx, notebook)).Should(Succeed())
+			Eventually(func() bool {
+				return apierrs.IsNotFound(k8sClient.Get(ctx, policyLookupKey, &networkingv1.NetworkPolicy{}))
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("Should provision a dedicated ServiceAccount", func() {
+			By("By creating a notebook asking for a service account")
+			ctx := context.Background()
+			const accountName = "test-account-notebook"
+			notebook := &operatorsv2.Jupyter{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      accountName,
+					Namespace: Namespace,
+				},
+				Spec: operatorsv2.JupyterSpec{
+					Template: operatorsv2.JupyterTemplate{
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{
+								Name:  "busybox",
+								Image: "busybox",
+							}},
+						},
+					},
+					ServiceAccount: &operatorsv2.NotebookServiceAccount{
+						ClusterRole: "view",
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, notebook)).Should(Succeed())
+
+			lookupKey := types.NamespacedName{Name: accountName, Namespace: Namespace}
+
+			By("By checking the service account and its role binding")
+			Eventually(func() error {
+				return k8sClient.Get(ctx, lookupKey, &v1.ServiceAccount{})
+			}, timeout, interval).Should(Succeed())
+
+			binding := &rbacv1.RoleBinding{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, lookupKey, binding)
+			}, timeout, interval).Should(Succeed())
+			Expect(binding.RoleRef.Kind).To(Equal("ClusterRole"))
+			Expect(binding.RoleRef.Name).To(Equal("view"))
+
+			By("By checking the pod runs as the service account")
+			sts := &appsv1.StatefulSet{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, lookupKey, sts)
+			}, timeout, interval).Should(Succeed())
+			Expect(sts.Spec.Template.Spec.ServiceAccountName).To(Equal(accountName))
+		})
+
+		It("Should refuse a ClusterRole that isn't allowed", func() {
+			ctx := context.Background()
+			const refusedName = "test-refused-role-notebook"
+			notebook := &operatorsv2.Jupyter{
+				ObjectMeta: metav1.ObjectMeta{Name: refusedName, Namespace: Namespace},
+				Spec: operatorsv2.JupyterSpec{
+					Template: operatorsv2.JupyterTemplate{
+						Spec: v1.PodSpec{Containers: []v1.Container{{Name: "busybox", Image: "busybox"}}},
+					},
+					ServiceAccount: &operatorsv2.NotebookServiceAccount{ClusterRole: "cluster-admin"},
+				},
+			}
+			Expect(k8sClient.Create(ctx, notebook)).Should(Succeed())
+
+			lookupKey := types.NamespacedName{Name: refusedName, Namespace: Namespace}
+			Eventually(func() string {
+				if err := k8sClient.Get(ctx, lookupKey, notebook); err != nil {
+					return ""
+				}
+				return notebook.Status.Reason
+			}, timeout, interval).Should(ContainSubstring("ClusterRole cluster-admin isn't allowed"))
+			Expect(k8sClient.Get(ctx, lookupKey, &rbacv1.RoleBinding{})).ShouldNot(Succeed())
+			Expect(k8sClient.Get(ctx, lookupKey, &appsv1.StatefulSet{})).ShouldNot(Succeed())
+		})
+
+		It("Should not take over a ServiceAccount it doesn't own", func() {
+			ctx := context.Background()
+			const foreignName = "test-foreign-account-notebook"
+			Expect(k8sClient.Create(ctx, &v1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{Name: foreignName, Namespace: Namespace},
+			})).Should(Succeed())
+			notebook := &operatorsv2.Jupyter{
+				ObjectMeta: metav1.ObjectMeta{Name: foreignName, Namespace: Namespace},
+				Spec: operatorsv2.JupyterSpec{
+					Template: operatorsv2.JupyterTemplate{
+						Spec: v1.PodSpec{Containers: []v1.Container{{Name: "busybox", Image: "busybox"}}},
+					},
+					ServiceAccount: &operatorsv2.NotebookServiceAccount{ClusterRole: "view"},
+				},
+			}
+			Expect(k8sClient.Create(ctx, notebook)).Should(Succeed())
+
+			lookupKey := types.NamespacedName{Name: foreignName, Namespace: Namespace}
+			Eventually(func() string {
+				if err := k8sClient.Get(ctx, lookupKey, notebook); err != nil {
+					return ""
+				}
+				return notebook.Status.Reason
+			}, timeout, interval).Should(ContainSubstring("isn't owned by the notebook"))
+			Expect(k8sClient.Get(ctx, lookupKey, &rbacv1.RoleBinding{})).ShouldNot(Succeed())
+			Expect(k8sClient.Get(ctx, lookupKey, &appsv1.StatefulSet{})).ShouldNot(Succeed())
+		})
+
+		It("Should restart the notebook on demand", func() {
+			ctx := context.Background()
+			notebookLookupKey := types.NamespacedName{Name: Name, Namespace: Namespace}
+
+			By("By annotating the notebook with restartedAt")
+			notebook := &operatorsv2.Jupyter{}
+			Expect(k8sClient.Get(ctx, notebookLookupKey, notebook)).Should(Succeed())
+			if notebook.Annotations == nil {
+				notebook.Annotations = map[string]string{}
+			}
+			notebook.Annotations[operatorsv2.RestartedAtAnnotation] = "2021-06-01T10:00:00Z"
+			Expect(k8sClient.Update(ctx, notebook)).Should(Succeed())
+
+			By("By checking that the pod template is stamped")
+			Eventually(func() string {
+				sts := &appsv1.StatefulSet{}
+				if err := k8sClient.Get(ctx, notebookLookupKey, sts); err != nil {
+					return ""
+				}
+				return sts.Spec.Template.Annotations[operatorsv2.RestartedAtAnnotation]
+			}, timeout, interval).Should(Equal("2021-06-01T10:00:00Z"))
+
+			By("By checking that the restart is recorded in status")
+			Eventually(func() string {
+				if err := k8sClient.Get(ctx, notebookLookupKey, notebook); err != nil {
+					return ""
+				}
+				return notebook.Status.RestartedAt
+			}, timeout, interval).Should(Equal("2021-06-01T10:00:00Z"))
+		})
+
+		It("Should keep fields set by other managers", func() {
+			ctx := context.Background()
+			notebookLookupKey := types.NamespacedName{Name: Name, Namespace: Namespace}
+
+			By("By labelling the statefulset from another manager")
+			sts := &appsv1.StatefulSet{}
+			Expect(k8sClient.Get(ctx, notebookLookupKey, sts)).Should(Succeed())
+			sts.Labels = map[string]string{"team": "data"}
+			Expect(k8sClient.Update(ctx, sts, client.FieldOwner("someone-else"))).Should(Succeed())
+
+			By("By changing the notebook to trigger a reconcile")
+			notebook := &operatorsv2.Jupyter{}
+			Expect(k8sClient.Get(ctx, notebookLookupKey, notebook)).Should(Succeed())
+			notebook.Annotations[operatorsv2.RestartedAtAnnotation] = "2021-06-02T10:00:00Z"
+			Expect(k8sClient.Update(ctx, notebook)).Should(Succeed())
+
+			By("By checking the label survived the reconcile")
+			Eventually(func() string {
+				if err := k8sClient.Get(ctx, notebookLookupKey, sts); err != nil {
+					return ""
+				}
+				return sts.Spec.Template.Annotations[operatorsv2.RestartedAtAnnotation]
+			}, timeout, interval).Should(Equal("2021-06-02T10:00:00Z"))
+			Expect(sts.Labels).To(HaveKeyWithValue("team", "data"))
+		})
+
+		It("Should propagate labels and annotations to the pod template", func() {
+			ctx := context.Background()
+			notebookLookupKey := types.NamespacedName{Name: Name, Namespace: Namespace}
+
+			By("By setting a notebook label and template metadata")
+			notebook := &operatorsv2.Jupyter{}
+			Expect(k8sClient.Get(ctx, notebookLookupKey, notebook)).Should(Succeed())
+			notebook.Labels = map[string]string{"cost-center": "research"}
+			notebook.Spec.Template.Metadata = operatorsv2.TemplateMetadata{
+				Labels:      map[string]string{"statefulset": "hijacked"},
+				Annotations: map[string]string{"prometheus.io/scrape": "true"},
+			}
+			Expect(k8sClient.Update(ctx, notebook)).Should(Succeed())
+
+			By("By checking the existing statefulset picks them up")
+			sts := &appsv1.StatefulSet{}
+			Eventually(func() string {
+				if err := k8sClient.Get(ctx, notebookLookupKey, sts); err != nil {
+					return ""
+				}
+				return sts.Spec.Template.Labels["cost-center"]
+			}, timeout, interval).Should(Equal("research"))
+			Expect(sts.Spec.Template.Annotations).To(HaveKeyWithValue("prometheus.io/scrape", "true"))
+			Expect(sts.Spec.Template.Labels).To(HaveKeyWithValue("statefulset", Name))
+		})
+
+		It("Should not protect a notebook whose server isn't running from node drains", func() {
+			ctx := context.Background()
+			notebookLookupKey := types.NamespacedName{Name: Name, Namespace: Namespace}
+
+			Consistently(func() error {
+				return k8sClient.Get(ctx, notebookLookupKey, &policyv1beta1.PodDisruptionBudget{})
+			}, time.Second, interval).ShouldNot(Succeed())
+		})
+
+		It("Should scale the notebook down while it is stopped", func() {
+			ctx := context.Background()
+			notebookLookupKey := types.NamespacedName{Name: Name, Namespace: Namespace}
+
+			By("By annotating the notebook as stopped")
+			notebook := &operatorsv2.Jupyter{}
+			Expect(k8sClient.Get(ctx, notebookLookupKey, notebook)).Should(Succeed())
+			notebook.Annotations[operatorsv2.StoppedAnnotation] = "2021-06-03T10:00:00Z"
+			Expect(k8sClient.Update(ctx, notebook)).Should(Succeed())
+
+			By("By checking the statefulset has no replicas")
+			Eventually(func() int32 {
+				sts := &appsv1.StatefulSet{}
+				if err := k8sClient.Get(ctx, notebookLookupKey, sts); err != nil || sts.Spec.Replicas == nil {
+					return -1
+				}
+				return *sts.Spec.Replicas
+			}, timeout, interval).Should(Equal(int32(0)))
+
+			By("By starting the notebook again")
+			Expect(k8sClient.Get(ctx, notebookLookupKey, notebook)).Should(Succeed())
+			delete(notebook.Annotations, operatorsv2.StoppedAnnotation)
+			Expect(k8sClient.Update(ctx, notebook)).Should(Succeed())
+
+			Eventually(func() int32 {
+				sts := &appsv1.StatefulSet{}
+				if err := k8sClient.Get(ctx, notebookLookupKey, sts); err != nil || sts.Spec.Replicas == nil {
+					return -1
+				}
+				return *sts.Spec.Replicas
+			}, timeout, interval).Should(Equal(int32(1)))
+		})
+
+		It("Should run and upgrade the image of a catalog entry", func() {
+			By("By creating a catalog entry and a notebook naming it")
+			ctx := context.Background()
+			const catalogName = "test-catalog-notebook"
+			image := &operatorsv2.NotebookImage{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-scipy"},
+				Spec:       operatorsv2.NotebookImageSpec{Image: "jupyter/scipy-notebook:2021-06-01"},
+			}
+			Expect(k8sClient.Create(ctx, image)).Should(Succeed())
+			notebook := &operatorsv2.Jupyter{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      catalogName,
+					Namespace: Namespace,
+				},
+				Spec: operatorsv2.JupyterSpec{
+					Template: operatorsv2.JupyterTemplate{
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{Name: "notebook"}},
+						},
+					},
+					NotebookImage: "test-scipy",
+				},
+			}
+			Expect(k8sClient.Create(ctx, notebook)).Should(Succeed())
+
+			notebookLookupKey := types.NamespacedName{Name: catalogName, Namespace: Namespace}
+			stsImage := func() string {
+				sts := &appsv1.StatefulSet{}
+				if err := k8sClient.Get(ctx, notebookLookupKey, sts); err != nil {
+					return ""
+				}
+				return sts.Spec.Template.Spec.Containers[0].Image
+			}
+			Eventually(stsImage, timeout, interval).Should(Equal("jupyter/scipy-notebook:2021-06-01"))
+
+			By("By updating the catalog entry")
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "test-scipy"}, image)).Should(Succeed())
+			image.Spec.Image = "jupyter/scipy-notebook:2021-07-01"
+			Expect(k8sClient.Update(ctx, image)).Should(Succeed())
+			Eventually(stsImage, timeout, interval).Should(Equal("jupyter/scipy-notebook:2021-07-01"))
+
+			By("By checking the catalog entry counts the notebook")
+			Eventually(func() int32 {
+				if err := k8sClient.Get(ctx, types.NamespacedName{Name: "test-scipy"}, image); err != nil {
+					return -1
+				}
+				return image.Status.Notebooks
+			}, timeout, interval).Should(Equal(int32(1)))
+		})
+	})
+})
+
+// forbiddenBindClient refuses the RoleBindings applied through it, as the
+// API server does for a ClusterRole the operator may not bind. The fake
+// client doesn't support server-side apply, the other applies succeed.
+type forbiddenBindClient struct {
+	client.Client
+}
+
+func (c forbiddenBindClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if _, ok := obj.(*rbacv1.RoleBinding); ok {
+		return apierrs.NewForbidden(schema.GroupResource{Group: "rbac.authorization.k8s.io", Resource: "rolebindings"}, obj.GetName(),
+			errors.New("attempting to grant RBAC permissions not currently held"))
+	}
+	return nil
+}
+
+var _ = Describe("Notebook ServiceAccount", func() {
+	It("Should refuse a ClusterRole the operator may not bind", func() {
+		scheme := runtime.NewScheme()
+		Expect(v1.AddToScheme(scheme)).To(Succeed())
+		Expect(rbacv1.AddToScheme(scheme)).To(Succeed())
+		Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+		r := &JupyterReconciler{
+			Client: forbiddenBindClient{fake.NewFakeClientWithScheme(scheme)},
+			Log:    ctrl.Log.WithName("serviceaccount"),
+			Scheme: scheme,
+			Config: configv1alpha1.NotebookConfig{ServiceAccountClusterRoles: []string{"admin"}},
+		}
+		instance := &operatorsv2.Jupyter{
+			ObjectMeta: metav1.ObjectMeta{Name: "admin", Namespace: "default", UID: "admin-uid"},
+			Spec: operatorsv2.JupyterSpec{
+				ServiceAccount: &operatorsv2.NotebookServiceAccount{ClusterRole: "admin"},
+			},
+		}
+
+		refused, err := r.reconcileServiceAccount(context.Background(), instance)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(refused).To(ContainSubstring("isn't allowed to bind ClusterRole admin"))
 	})
 })
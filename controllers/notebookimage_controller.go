@@ -0,0 +1,212 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/go-logr/logr"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// NotebookImageReconciler reconciles a NotebookImage object
+type NotebookImageReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=notebookimages,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=notebookimages/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=notebookimages/finalizers,verbs=update
+
+// Reconcile reports the notebooks using a catalog entry and those whose pod
+// doesn't run its image yet. The notebooks pick up a change of the entry
+// themselves, according to their update policy. Only an operator watching
+// all namespaces sees all the notebooks, the status is left to it.
+func (r *NotebookImageReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("notebookimage", req.NamespacedName)
+
+	image := &operatorsv2.NotebookImage{}
+	if err := r.Get(ctx, req.NamespacedName, image); err != nil {
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, nil // Ignore not found error
+		}
+		log.Error(err, "unable to fetch notebook image")
+		return ctrl.Result{}, err
+	}
+
+	images := &operatorsv2.NotebookImageList{}
+	if err := r.List(ctx, images); err != nil {
+		return ctrl.Result{}, err
+	}
+	notebooks := &operatorsv2.JupyterList{}
+	if err := r.List(ctx, notebooks); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	oldStatus := image.Status.DeepCopy()
+	setImageStatus(image, defaultNotebookImage(images.Items), notebooks.Items)
+	if !reflect.DeepEqual(oldStatus, &image.Status) {
+		if err := r.Status().Update(ctx, image); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// defaultNotebookImage returns the catalog entry run by notebooks that set
+// neither an image nor an entry, the first by name when several are default.
+func defaultNotebookImage(images []operatorsv2.NotebookImage) *operatorsv2.NotebookImage {
+	var found *operatorsv2.NotebookImage
+	for i := range images {
+		if images[i].Spec.Default && (found == nil || images[i].Name < found.Name) {
+			found = &images[i]
+		}
+	}
+	return found
+}
+
+// usesDefaultImage reports whether a notebook sets neither an image nor a
+// catalog entry, so that it runs the default entry if there is one.
+func usesDefaultImage(notebook *operatorsv2.Jupyter) bool {
+	containers := notebook.Spec.Template.Spec.Containers
+	return notebook.Spec.NotebookImage == "" && (len(containers) == 0 || containers[0].Image == "")
+}
+
+// catalogImage returns the catalog entry the notebook names, or the default
+// entry when the notebook sets no image. It is nil when the notebook doesn't
+// use the catalog, the reason explains why the entry it names can't be used.
+func catalogImage(ctx context.Context, c client.Reader, notebook *operatorsv2.Jupyter) (*operatorsv2.NotebookImage, string, error) {
+	if name := notebook.Spec.NotebookImage; name != "" {
+		image := &operatorsv2.NotebookImage{}
+		if err := c.Get(ctx, types.NamespacedName{Name: name}, image); err != nil {
+			if apierrs.IsNotFound(err) {
+				return nil, fmt.Sprintf("NotebookImage %s not found", name), nil
+			}
+			return nil, "", err
+		}
+		return image, "", nil
+	}
+
+	if !usesDefaultImage(notebook) {
+		return nil, "", nil
+	}
+	images := &operatorsv2.NotebookImageList{}
+	if err := c.List(ctx, images); err != nil {
+		return nil, "", err
+	}
+	return defaultNotebookImage(images.Items), "", nil
+}
+
+// catalogImageName returns the catalog entry a notebook runs, if any.
+func catalogImageName(notebook *operatorsv2.Jupyter, defaultImage *operatorsv2.NotebookImage) string {
+	if usesDefaultImage(notebook) && defaultImage != nil {
+		return defaultImage.Name
+	}
+	return notebook.Spec.NotebookImage
+}
+
+// setImageStatus counts the notebooks running a catalog entry and lists those
+// still running another image.
+func setImageStatus(image, defaultImage *operatorsv2.NotebookImage, notebooks []operatorsv2.Jupyter) {
+	image.Status.Notebooks = 0
+	image.Status.OutdatedNotebooks = nil
+	for i := range notebooks {
+		notebook := &notebooks[i]
+		if catalogImageName(notebook, defaultImage) != image.Name {
+			continue
+		}
+		image.Status.Notebooks++
+		if notebook.Status.Image != image.Spec.Image {
+			image.Status.OutdatedNotebooks = append(image.Status.OutdatedNotebooks, notebook.Namespace+"/"+notebook.Name)
+		}
+	}
+	sort.Strings(image.Status.OutdatedNotebooks)
+}
+
+// imagesForNotebook maps a notebook to the catalog entries whose status
+// counts it, any default entry may count a notebook setting no image. Both
+// the old and the new notebook of an update are mapped.
+func (r *NotebookImageReconciler) imagesForNotebook(obj client.Object) []reconcile.Request {
+	notebook, ok := obj.(*operatorsv2.Jupyter)
+	if !ok {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	if notebook.Spec.NotebookImage != "" {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: notebook.Spec.NotebookImage}})
+	}
+	if !usesDefaultImage(notebook) {
+		return requests
+	}
+
+	images := &operatorsv2.NotebookImageList{}
+	if err := r.List(context.Background(), images); err != nil {
+		r.Log.Error(err, "unable to list notebook images")
+		return requests
+	}
+	for _, image := range images.Items {
+		if image.Spec.Default {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: image.Name}})
+		}
+	}
+	return requests
+}
+
+// notebookImageChanged filters out the notebook updates that leave the
+// catalog entry used and the image run unchanged, e.g. those of the activity
+// recorded in the status.
+var notebookImageChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		old, ok := e.ObjectOld.(*operatorsv2.Jupyter)
+		if !ok {
+			return true
+		}
+		notebook, ok := e.ObjectNew.(*operatorsv2.Jupyter)
+		if !ok {
+			return true
+		}
+		return old.Spec.NotebookImage != notebook.Spec.NotebookImage ||
+			usesDefaultImage(old) != usesDefaultImage(notebook) ||
+			old.Status.Image != notebook.Status.Image
+	},
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *NotebookImageReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&operatorsv2.NotebookImage{}).
+		Watches(&source.Kind{Type: &operatorsv2.Jupyter{}}, handler.EnqueueRequestsFromMapFunc(r.imagesForNotebook),
+			builder.WithPredicates(notebookImageChanged)).
+		Complete(r)
+}
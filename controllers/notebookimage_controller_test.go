@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("NotebookImage catalog", func() {
+	newImage := func(name, image string, isDefault bool) operatorsv2.NotebookImage {
+		return operatorsv2.NotebookImage{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       operatorsv2.NotebookImageSpec{Image: image, Default: isDefault},
+		}
+	}
+	newNotebook := func(name, catalogName, image, running string) operatorsv2.Jupyter {
+		return operatorsv2.Jupyter{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: operatorsv2.JupyterSpec{
+				NotebookImage: catalogName,
+				Template: operatorsv2.JupyterTemplate{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: name, Image: image}}},
+				},
+			},
+			Status: operatorsv2.JupyterStatus{Image: running},
+		}
+	}
+
+	It("Should pick the first default entry by name", func() {
+		images := []operatorsv2.NotebookImage{
+			newImage("scipy", "jupyter/scipy-notebook", true),
+			newImage("base", "jupyter/base-notebook", false),
+			newImage("minimal", "jupyter/minimal-notebook", true),
+		}
+		Expect(defaultNotebookImage(images).Name).To(Equal("minimal"))
+		Expect(defaultNotebookImage(images[1:2])).To(BeNil())
+	})
+
+	It("Should list the notebooks running an outdated image", func() {
+		image := newImage("scipy", "jupyter/scipy-notebook:2021-07-01", true)
+		notebooks := []operatorsv2.Jupyter{
+			newNotebook("current", "scipy", "", "jupyter/scipy-notebook:2021-07-01"),
+			newNotebook("outdated", "scipy", "", "jupyter/scipy-notebook:2021-06-01"),
+			newNotebook("implicit", "", "", "jupyter/scipy-notebook:2021-06-01"),
+			newNotebook("own-image", "", "jupyter/base-notebook", "jupyter/base-notebook"),
+			newNotebook("other", "base", "", "jupyter/base-notebook"),
+		}
+		setImageStatus(&image, &image, notebooks)
+		Expect(image.Status.Notebooks).To(Equal(int32(3)))
+		Expect(image.Status.OutdatedNotebooks).To(Equal([]string{"default/implicit", "default/outdated"}))
+	})
+
+	It("Should replace the template image with the catalog one", func() {
+		notebook := newNotebook("catalog", "scipy", "jupyter/base-notebook", "")
+		ss := desiredStatefulSet(&notebook, 1, "jupyter/scipy-notebook", false, configv1alpha1.NotebookConfig{})
+		Expect(ss.Spec.Template.Spec.Containers[0].Image).To(Equal("jupyter/scipy-notebook"))
+	})
+
+	It("Should only requeue the entries on a change of the image used", func() {
+		notebook := newNotebook("watched", "scipy", "", "jupyter/scipy-notebook")
+		active := notebook.DeepCopy()
+		active.Status.LastActivity = &metav1.Time{}
+		Expect(notebookImageChanged.Update(event.UpdateEvent{ObjectOld: &notebook, ObjectNew: active})).To(BeFalse())
+
+		updated := notebook.DeepCopy()
+		updated.Status.Image = "jupyter/scipy-notebook:2021-07-01"
+		Expect(notebookImageChanged.Update(event.UpdateEvent{ObjectOld: &notebook, ObjectNew: updated})).To(BeTrue())
+
+		switched := notebook.DeepCopy()
+		switched.Spec.NotebookImage = "base"
+		Expect(notebookImageChanged.Update(event.UpdateEvent{ObjectOld: &notebook, ObjectNew: switched})).To(BeTrue())
+	})
+
+	It("Should only requeue the default entries for notebooks setting no image", func() {
+		scheme := runtime.NewScheme()
+		Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+		minimal := newImage("minimal", "jupyter/minimal-notebook", true)
+		r := &NotebookImageReconciler{Client: fake.NewFakeClientWithScheme(scheme, &minimal)}
+
+		named := newNotebook("named", "scipy", "", "")
+		Expect(r.imagesForNotebook(&named)).To(Equal([]reconcile.Request{{NamespacedName: types.NamespacedName{Name: "scipy"}}}))
+		implicit := newNotebook("implicit", "", "", "")
+		Expect(r.imagesForNotebook(&implicit)).To(Equal([]reconcile.Request{{NamespacedName: types.NamespacedName{Name: "minimal"}}}))
+	})
+
+	Describe("Resolving the image of a notebook", func() {
+		newReconciler := func(objs ...runtime.Object) (*JupyterReconciler, *record.FakeRecorder) {
+			scheme := runtime.NewScheme()
+			Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+			recorder := record.NewFakeRecorder(10)
+			return &JupyterReconciler{
+				Client:   fake.NewFakeClientWithScheme(scheme, objs...),
+				Log:      ctrl.Log.WithName("images"),
+				Recorder: recorder,
+			}, recorder
+		}
+
+		It("Should keep the running image when the entry is missing", func() {
+			r, _ := newReconciler()
+			notebook := newNotebook("missing", "scipy", "", "jupyter/scipy-notebook:2021-06-01")
+			image, reason, err := r.resolveImage(context.Background(), &notebook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(image).To(Equal("jupyter/scipy-notebook:2021-06-01"))
+			Expect(reason).To(ContainSubstring("NotebookImage scipy not found"))
+		})
+
+		It("Should warn about a deprecated entry once", func() {
+			deprecated := newImage("scipy", "jupyter/scipy-notebook", false)
+			deprecated.Spec.Deprecated = true
+			r, recorder := newReconciler(&deprecated)
+			notebook := newNotebook("old", "scipy", "", "")
+
+			image, _, err := r.resolveImage(context.Background(), &notebook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(image).To(Equal("jupyter/scipy-notebook"))
+			Expect(notebook.Status.DeprecatedImage).To(Equal("scipy"))
+			Expect(recorder.Events).To(HaveLen(1))
+
+			_, _, err = r.resolveImage(context.Background(), &notebook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorder.Events).To(HaveLen(1))
+		})
+	})
+})
@@ -0,0 +1,415 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// workspacePollPeriod is how often a run waiting for its workspace checks
+// whether the notebook has stopped
+const workspacePollPeriod = 30 * time.Second
+
+// NotebookRunReconciler reconciles a NotebookRun object
+type NotebookRunReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Config holds the default image and resources, the profiles runs execute
+	// in and the image cloning git sources
+	Config configv1alpha1.NotebookConfig
+}
+
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=notebookruns,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=notebookruns/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=notebookruns/finalizers,verbs=update
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+
+// Reconcile executes the notebook of a NotebookRun in a Job, and reports the
+// progress of the Job in the run status.
+func (r *NotebookRunReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("notebookrun", req.NamespacedName)
+
+	run := &operatorsv2.NotebookRun{}
+	if err := r.Get(ctx, req.NamespacedName, run); err != nil {
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, nil // Ignore not found error
+		}
+		log.Error(err, "unable to fetch notebook run")
+		return ctrl.Result{}, err
+	}
+
+	if run.Status.Phase == operatorsv2.RunSucceeded || run.Status.Phase == operatorsv2.RunFailed {
+		return ctrl.Result{}, nil
+	}
+
+	job := &batchv1.Job{}
+	err := r.Get(ctx, req.NamespacedName, job)
+	if apierrs.IsNotFound(err) {
+		waiting, err := r.workspaceInUse(ctx, run)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if waiting != "" {
+			// The Job would stay Pending without saying why
+			if run.Status.Phase != operatorsv2.RunPending || run.Status.Reason != waiting {
+				run.Status.Phase = operatorsv2.RunPending
+				run.Status.Reason = waiting
+				if err := r.Status().Update(ctx, run); err != nil {
+					return ctrl.Result{}, err
+				}
+				r.Recorder.Event(run, corev1.EventTypeNormal, "WaitingForWorkspace", waiting)
+			}
+			return ctrl.Result{RequeueAfter: workspacePollPeriod}, nil
+		}
+
+		var message string
+		job, message, err = r.generateJob(ctx, run)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if message != "" {
+			return ctrl.Result{}, r.fail(ctx, run, message)
+		}
+		if err = ctrl.SetControllerReference(run, job, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+		log.Info("Creating Job", "namespace", job.Namespace, "name", job.Name)
+		if err = r.Create(ctx, job); err != nil {
+			log.Error(err, "unable to create job")
+			return ctrl.Result{}, err
+		}
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	oldStatus := run.Status.DeepCopy()
+	setRunStatus(&run.Status, job)
+	if run.Status.Phase == operatorsv2.RunFailed {
+		pods := &corev1.PodList{}
+		if err := r.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+			return ctrl.Result{}, err
+		}
+		if exit := exitReason(pods.Items); exit != "" {
+			run.Status.Reason += ": " + exit
+		}
+	}
+
+	if reflect.DeepEqual(oldStatus, &run.Status) {
+		return ctrl.Result{}, nil
+	}
+	if err := r.Status().Update(ctx, run); err != nil {
+		return ctrl.Result{}, err
+	}
+	switch run.Status.Phase {
+	case operatorsv2.RunSucceeded:
+		r.Recorder.Eventf(run, corev1.EventTypeNormal, "RunSucceeded", "Notebook %s ran to completion", run.Spec.Notebook)
+	case operatorsv2.RunFailed:
+		r.Recorder.Event(run, corev1.EventTypeWarning, "RunFailed", run.Status.Reason)
+	}
+	return ctrl.Result{}, nil
+}
+
+// generateJob resolves the source and environment of a run into its Job.
+// The message explains why the run can't execute, when it can't.
+func (r *NotebookRunReconciler) generateJob(ctx context.Context, run *operatorsv2.NotebookRun) (*batchv1.Job, string, error) {
+	source, environment := run.Spec.Source, run.Spec.Environment
+	if (source.Workspace == "") == (source.Git == nil) {
+		return nil, "exactly one of source.workspace and source.git must be set", nil
+	}
+	if (environment.Jupyter == "") == (environment.Profile == "") {
+		return nil, "exactly one of environment.jupyter and environment.profile must be set", nil
+	}
+
+	var podSpec *corev1.PodSpec
+	var catalog *operatorsv2.NotebookImage
+	if environment.Jupyter != "" {
+		notebook, message, err := r.getNotebook(ctx, run.Namespace, environment.Jupyter)
+		if notebook == nil {
+			return nil, message, err
+		}
+		podSpec = notebook.Spec.Template.Spec.DeepCopy()
+		// The run executes in the image the notebook runs
+		if catalog, message, err = catalogImage(ctx, r.Client, notebook); message != "" || err != nil {
+			return nil, message, err
+		}
+		if notebook.Spec.ServiceAccount != nil {
+			// Same checks as the notebook, the run must not borrow someone else's account
+			if role := notebook.Spec.ServiceAccount.ClusterRole; !r.Config.AllowsClusterRole(role) {
+				return nil, fmt.Sprintf("ClusterRole %s isn't allowed for notebook ServiceAccounts", role), nil
+			}
+			account := &corev1.ServiceAccount{}
+			if err := r.Get(ctx, types.NamespacedName{Name: notebook.Name, Namespace: notebook.Namespace}, account); client.IgnoreNotFound(err) != nil {
+				return nil, "", err
+			} else if err == nil && !metav1.IsControlledBy(account, notebook) {
+				return nil, fmt.Sprintf("ServiceAccount %s isn't owned by notebook %s", account.Name, notebook.Name), nil
+			}
+			podSpec.ServiceAccountName = notebook.Name
+		}
+	} else {
+		profile, ok := r.Config.Profiles[environment.Profile]
+		if !ok {
+			return nil, fmt.Sprintf("profile %s not found", environment.Profile), nil
+		}
+		podSpec = profile.DeepCopy()
+	}
+	if len(podSpec.Containers) == 0 {
+		return nil, "the environment has no container", nil
+	}
+	if catalog != nil {
+		podSpec.Containers[0].Image = catalog.Spec.Image
+	}
+
+	var workspace *operatorsv2.Jupyter
+	if source.Workspace != "" {
+		notebook, message, err := r.getNotebook(ctx, run.Namespace, source.Workspace)
+		if notebook == nil {
+			return nil, message, err
+		}
+		if notebook.Spec.Workspace == nil {
+			return nil, fmt.Sprintf("notebook %s has no workspace", notebook.Name), nil
+		}
+		workspace = notebook
+	} else if r.Config.GitImage == "" {
+		return nil, "git sources are disabled, the operator configuration sets no gitImage", nil
+	}
+
+	ApplyContainerDefaults(&podSpec.Containers[0], r.Config.DefaultImage, r.Config.DefaultResources)
+	return generateRunJob(run, podSpec, workspace, r.Config.GitImage), "", nil
+}
+
+// workspaceInUse explains why the run can't mount the workspace it reads
+// from yet: a ReadWriteOnce claim is attached to the node of the running
+// notebook, a Job scheduled elsewhere would stay Pending.
+func (r *NotebookRunReconciler) workspaceInUse(ctx context.Context, run *operatorsv2.NotebookRun) (string, error) {
+	if run.Spec.Source.Workspace == "" {
+		return "", nil
+	}
+	notebook := &operatorsv2.Jupyter{}
+	if err := r.Get(ctx, types.NamespacedName{Name: run.Spec.Source.Workspace, Namespace: run.Namespace}, notebook); err != nil {
+		// generateJob reports the missing notebook
+		return "", client.IgnoreNotFound(err)
+	}
+	if notebook.Spec.Workspace == nil || notebook.Status.Phase == operatorsv2.JupyterStopped {
+		return "", nil
+	}
+	pvc := &corev1.PersistentVolumeClaim{}
+	if err := r.Get(ctx, types.NamespacedName{Name: workspaceName(notebook), Namespace: notebook.Namespace}, pvc); err != nil {
+		return "", client.IgnoreNotFound(err)
+	}
+	for _, mode := range pvc.Spec.AccessModes {
+		if mode == corev1.ReadWriteMany {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("Waiting for notebook %s to stop, its workspace %s can only be mounted by one node", notebook.Name, pvc.Name), nil
+}
+
+// getNotebook returns the named notebook, or why it can't be used.
+func (r *NotebookRunReconciler) getNotebook(ctx context.Context, namespace, name string) (*operatorsv2.Jupyter, string, error) {
+	notebook := &operatorsv2.Jupyter{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, notebook); err != nil {
+		if apierrs.IsNotFound(err) {
+			return nil, fmt.Sprintf("notebook %s not found", name), nil
+		}
+		return nil, "", err
+	}
+	return notebook, "", nil
+}
+
+// fail marks the run as failed for a reason retrying won't fix.
+func (r *NotebookRunReconciler) fail(ctx context.Context, run *operatorsv2.NotebookRun, reason string) error {
+	r.Recorder.Event(run, corev1.EventTypeWarning, "RunFailed", reason)
+	now := metav1.Now()
+	run.Status.Phase = operatorsv2.RunFailed
+	run.Status.CompletionTime = &now
+	run.Status.Reason = reason
+	return r.Status().Update(ctx, run)
+}
+
+// runOutput returns where the executed notebook is written.
+func runOutput(run *operatorsv2.NotebookRun) string {
+	if run.Spec.Output != "" {
+		return run.Spec.Output
+	}
+	return strings.TrimSuffix(run.Spec.Notebook, ".ipynb") + "-output.ipynb"
+}
+
+// generateRunJob runs papermill in the first container of podSpec, from the
+// workspace of the given notebook or from a clone of the git source made with
+// gitImage.
+func generateRunJob(run *operatorsv2.NotebookRun, podSpec *corev1.PodSpec, workspace *operatorsv2.Jupyter, gitImage string) *batchv1.Job {
+	backoffLimit := int32(0)
+	if run.Spec.BackoffLimit != nil {
+		backoffLimit = *run.Spec.BackoffLimit
+	}
+
+	// Sidecars of an interactive notebook would keep the Job from completing
+	podSpec.Containers = podSpec.Containers[:1]
+	podSpec.RestartPolicy = corev1.RestartPolicyNever
+
+	container := &podSpec.Containers[0]
+	container.Command = []string{"papermill", run.Spec.Notebook, runOutput(run)}
+	keys := make([]string, 0, len(run.Spec.Parameters))
+	for k := range run.Spec.Parameters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		container.Command = append(container.Command, "-p", k, run.Spec.Parameters[k])
+	}
+	container.Args = nil
+	container.Ports = nil
+	container.LivenessProbe = nil
+	container.ReadinessProbe = nil
+	container.StartupProbe = nil
+	// Surface the papermill traceback in the run status
+	container.TerminationMessagePolicy = corev1.TerminationMessageFallbackToLogsOnError
+
+	if workspace != nil {
+		mountPath := workspace.Spec.Workspace.MountPath
+		if mountPath == "" {
+			mountPath = "/home/jovyan"
+		}
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "workspace",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: workspaceName(workspace)},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: "workspace", MountPath: mountPath})
+		container.WorkingDir = mountPath
+	} else {
+		git := run.Spec.Source.Git
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name:         "source",
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+		mount := corev1.VolumeMount{Name: "source", MountPath: "/src"}
+		podSpec.InitContainers = append(podSpec.InitContainers, corev1.Container{
+			Name:  "clone",
+			Image: gitImage,
+			// The repository and revision are passed as arguments, not interpolated
+			Command: []string{"sh", "-c",
+				`git clone "$0" /src && if [ -n "$1" ]; then git -C /src checkout "$1"; fi`,
+				git.Repository, git.Revision},
+			VolumeMounts: []corev1.VolumeMount{mount},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, mount)
+		container.WorkingDir = mount.MountPath
+	}
+
+	labels := map[string]string{"notebook-run": run.Name}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      run.Name,
+			Namespace: run.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: run.Spec.ActiveDeadlineSeconds,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       *podSpec,
+			},
+		},
+	}
+}
+
+// setRunStatus reports the progress of the Job of a run.
+func setRunStatus(status *operatorsv2.NotebookRunStatus, job *batchv1.Job) {
+	status.JobName = job.Name
+	status.Reason = ""
+	status.StartTime = job.Status.StartTime
+	status.Phase = operatorsv2.RunPending
+	if job.Status.Active > 0 {
+		status.Phase = operatorsv2.RunRunning
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			status.Phase = operatorsv2.RunSucceeded
+			status.CompletionTime = job.Status.CompletionTime
+			return
+		case batchv1.JobFailed:
+			completionTime := condition.LastTransitionTime
+			status.Phase = operatorsv2.RunFailed
+			status.CompletionTime = &completionTime
+			status.Reason = condition.Reason
+			return
+		}
+	}
+}
+
+// exitReason describes how the notebook container of the last failed pod
+// terminated.
+func exitReason(pods []corev1.Pod) string {
+	var last *corev1.ContainerStateTerminated
+	for _, pod := range pods {
+		for _, cs := range pod.Status.ContainerStatuses {
+			terminated := cs.State.Terminated
+			if terminated == nil || terminated.ExitCode == 0 {
+				continue
+			}
+			if last == nil || last.FinishedAt.Before(&terminated.FinishedAt) {
+				last = terminated
+			}
+		}
+	}
+	if last == nil {
+		return ""
+	}
+	reason := fmt.Sprintf("exited with code %d", last.ExitCode)
+	if message := strings.TrimSpace(last.Message); message != "" {
+		reason += ": " + message
+	}
+	return reason
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *NotebookRunReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&operatorsv2.NotebookRun{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("NotebookRun controller", func() {
+	const (
+		Namespace = "default"
+		timeout   = time.Second * 10
+		interval  = time.Millisecond * 250
+	)
+
+	Context("When running a notebook", func() {
+		It("Should run papermill in the notebook environment", func() {
+			ctx := context.Background()
+			notebook := &operatorsv2.Jupyter{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "run-notebook",
+					Namespace: Namespace,
+					// The run mounts the ReadWriteOnce workspace once the notebook is stopped
+					Annotations: map[string]string{operatorsv2.StoppedAnnotation: "2021-06-01T00:00:00Z"},
+				},
+				Spec: operatorsv2.JupyterSpec{
+					Workspace: &operatorsv2.NotebookWorkspace{Size: resource.MustParse("1Gi")},
+					Template: operatorsv2.JupyterTemplate{
+						Spec: v1.PodSpec{Containers: []v1.Container{{Name: "busybox", Image: "busybox"}}},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, notebook)).Should(Succeed())
+
+			run := &operatorsv2.NotebookRun{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-run", Namespace: Namespace},
+				Spec: operatorsv2.NotebookRunSpec{
+					Notebook:    "report.ipynb",
+					Parameters:  map[string]string{"date": "2021-06-01"},
+					Source:      operatorsv2.NotebookRunSource{Workspace: "run-notebook"},
+					Environment: operatorsv2.NotebookRunEnvironment{Jupyter: "run-notebook"},
+				},
+			}
+			Expect(k8sClient.Create(ctx, run)).Should(Succeed())
+
+			By("By checking the Job is created")
+			lookupKey := types.NamespacedName{Name: "test-run", Namespace: Namespace}
+			job := &batchv1.Job{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, lookupKey, job)
+			}, timeout, interval).Should(Succeed())
+			container := job.Spec.Template.Spec.Containers[0]
+			Expect(container.Command).To(Equal([]string{"papermill", "report.ipynb", "report-output.ipynb", "-p", "date", "2021-06-01"}))
+			Expect(container.WorkingDir).To(Equal("/home/jovyan"))
+			Expect(job.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("run-notebook-workspace"))
+
+			By("By checking the run is pending")
+			Eventually(func() string {
+				if err := k8sClient.Get(ctx, lookupKey, run); err != nil {
+					return ""
+				}
+				return run.Status.JobName
+			}, timeout, interval).Should(Equal("test-run"))
+			Expect(run.Status.Phase).To(Equal(operatorsv2.RunPending))
+		})
+
+		It("Should fail for an unknown profile", func() {
+			ctx := context.Background()
+			run := &operatorsv2.NotebookRun{
+				ObjectMeta: metav1.ObjectMeta{Name: "unknown-profile", Namespace: Namespace},
+				Spec: operatorsv2.NotebookRunSpec{
+					Notebook:    "report.ipynb",
+					Source:      operatorsv2.NotebookRunSource{Git: &operatorsv2.GitSource{Repository: "https://example.com/notebooks.git"}},
+					Environment: operatorsv2.NotebookRunEnvironment{Profile: "missing"},
+				},
+			}
+			Expect(k8sClient.Create(ctx, run)).Should(Succeed())
+
+			Eventually(func() operatorsv2.NotebookRunPhase {
+				if err := k8sClient.Get(ctx, types.NamespacedName{Name: "unknown-profile", Namespace: Namespace}, run); err != nil {
+					return ""
+				}
+				return run.Status.Phase
+			}, timeout, interval).Should(Equal(operatorsv2.RunFailed))
+			Expect(run.Status.Reason).To(Equal("profile missing not found"))
+		})
+	})
+
+	Context("When the run reads from a workspace", func() {
+		newReconciler := func(objs ...runtime.Object) *NotebookRunReconciler {
+			scheme := runtime.NewScheme()
+			Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+			Expect(v1.AddToScheme(scheme)).To(Succeed())
+			return &NotebookRunReconciler{Client: fake.NewFakeClientWithScheme(scheme, objs...)}
+		}
+		newWorkspace := func(phase operatorsv2.JupyterPhase, mode v1.PersistentVolumeAccessMode) (*operatorsv2.Jupyter, *v1.PersistentVolumeClaim) {
+			notebook := &operatorsv2.Jupyter{
+				ObjectMeta: metav1.ObjectMeta{Name: "analysis", Namespace: Namespace},
+				Spec:       operatorsv2.JupyterSpec{Workspace: &operatorsv2.NotebookWorkspace{Size: resource.MustParse("1Gi")}},
+				Status:     operatorsv2.JupyterStatus{Phase: phase},
+			}
+			pvc := generateWorkspacePVC(notebook)
+			pvc.Spec.AccessModes = []v1.PersistentVolumeAccessMode{mode}
+			return notebook, pvc
+		}
+		run := &operatorsv2.NotebookRun{
+			ObjectMeta: metav1.ObjectMeta{Name: "analysis-run", Namespace: Namespace},
+			Spec:       operatorsv2.NotebookRunSpec{Source: operatorsv2.NotebookRunSource{Workspace: "analysis"}},
+		}
+
+		It("Should wait for the notebook to stop", func() {
+			r := newReconciler(newWorkspace(operatorsv2.JupyterRunning, v1.ReadWriteOnce))
+			waiting, err := r.workspaceInUse(context.Background(), run)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(waiting).To(Equal("Waiting for notebook analysis to stop, its workspace analysis-workspace can only be mounted by one node"))
+		})
+
+		It("Should mount the workspace of a stopped notebook", func() {
+			r := newReconciler(newWorkspace(operatorsv2.JupyterStopped, v1.ReadWriteOnce))
+			Expect(r.workspaceInUse(context.Background(), run)).To(BeEmpty())
+		})
+
+		It("Should share a ReadWriteMany workspace with the notebook", func() {
+			r := newReconciler(newWorkspace(operatorsv2.JupyterRunning, v1.ReadWriteMany))
+			Expect(r.workspaceInUse(context.Background(), run)).To(BeEmpty())
+		})
+	})
+
+	Context("When the environment runs a catalog image", func() {
+		newReconciler := func(objs ...runtime.Object) *NotebookRunReconciler {
+			scheme := runtime.NewScheme()
+			Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+			Expect(v1.AddToScheme(scheme)).To(Succeed())
+			return &NotebookRunReconciler{
+				Client: fake.NewFakeClientWithScheme(scheme, objs...),
+				Config: configv1alpha1.NotebookConfig{DefaultImage: "jupyter/base-notebook"},
+			}
+		}
+		notebook := &operatorsv2.Jupyter{
+			ObjectMeta: metav1.ObjectMeta{Name: "catalog", Namespace: Namespace},
+			Spec: operatorsv2.JupyterSpec{
+				NotebookImage: "scipy",
+				Template: operatorsv2.JupyterTemplate{
+					Spec: v1.PodSpec{Containers: []v1.Container{{Name: "notebook"}}},
+				},
+			},
+		}
+		run := &operatorsv2.NotebookRun{
+			ObjectMeta: metav1.ObjectMeta{Name: "catalog-run", Namespace: Namespace},
+			Spec: operatorsv2.NotebookRunSpec{
+				Notebook:    "report.ipynb",
+				Source:      operatorsv2.NotebookRunSource{Git: &operatorsv2.GitSource{Repository: "https://example.com/notebooks.git"}},
+				Environment: operatorsv2.NotebookRunEnvironment{Jupyter: "catalog"},
+			},
+		}
+
+		It("Should run the image of the entry", func() {
+			image := &operatorsv2.NotebookImage{
+				ObjectMeta: metav1.ObjectMeta{Name: "scipy"},
+				Spec:       operatorsv2.NotebookImageSpec{Image: "jupyter/scipy-notebook:2021-07-01"},
+			}
+			r := newReconciler(notebook.DeepCopy(), image)
+			r.Config.GitImage = "alpine/git:v2.43.0"
+			job, message, err := r.generateJob(context.Background(), run)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message).To(BeEmpty())
+			Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal("jupyter/scipy-notebook:2021-07-01"))
+		})
+
+		It("Should fail when the entry is missing", func() {
+			_, message, err := newReconciler(notebook.DeepCopy()).generateJob(context.Background(), run)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message).To(Equal("NotebookImage scipy not found"))
+		})
+	})
+
+	Context("When cloning the git source", func() {
+		It("Should use the configured image", func() {
+			run := &operatorsv2.NotebookRun{
+				ObjectMeta: metav1.ObjectMeta{Name: "git-run", Namespace: Namespace},
+				Spec: operatorsv2.NotebookRunSpec{
+					Notebook: "report.ipynb",
+					Source:   operatorsv2.NotebookRunSource{Git: &operatorsv2.GitSource{Repository: "https://example.com/notebooks.git"}},
+				},
+			}
+			podSpec := &v1.PodSpec{Containers: []v1.Container{{Name: "papermill"}}}
+			job := generateRunJob(run, podSpec, nil, "alpine/git:v2.43.0")
+			Expect(job.Spec.Template.Spec.InitContainers[0].Image).To(Equal("alpine/git:v2.43.0"))
+		})
+
+		It("Should fail when no image is configured", func() {
+			r := &NotebookRunReconciler{Config: configv1alpha1.NotebookConfig{
+				Profiles: map[string]v1.PodSpec{"papermill": {Containers: []v1.Container{{Name: "papermill"}}}},
+			}}
+			run := &operatorsv2.NotebookRun{
+				Spec: operatorsv2.NotebookRunSpec{
+					Source:      operatorsv2.NotebookRunSource{Git: &operatorsv2.GitSource{Repository: "https://example.com/notebooks.git"}},
+					Environment: operatorsv2.NotebookRunEnvironment{Profile: "papermill"},
+				},
+			}
+			_, message, err := r.generateJob(context.Background(), run)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message).To(Equal("git sources are disabled, the operator configuration sets no gitImage"))
+		})
+	})
+
+	Context("When following the Job of a run", func() {
+		It("Should report the failure reason", func() {
+			finishedAt := metav1.Now()
+			job := &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{Name: "failed-run"},
+				Status: batchv1.JobStatus{
+					StartTime: &finishedAt,
+					Conditions: []batchv1.JobCondition{{
+						Type:               batchv1.JobFailed,
+						Status:             v1.ConditionTrue,
+						Reason:             "BackoffLimitExceeded",
+						LastTransitionTime: finishedAt,
+					}},
+				},
+			}
+			status := &operatorsv2.NotebookRunStatus{}
+			setRunStatus(status, job)
+			Expect(status.Phase).To(Equal(operatorsv2.RunFailed))
+			Expect(status.Reason).To(Equal("BackoffLimitExceeded"))
+
+			pods := []v1.Pod{{
+				Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{
+					State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{
+						ExitCode:   1,
+						Message:    "PapermillExecutionError\n",
+						FinishedAt: finishedAt,
+					}},
+				}}},
+			}}
+			Expect(exitReason(pods)).To(Equal("exited with code 1: PapermillExecutionError"))
+		})
+	})
+})
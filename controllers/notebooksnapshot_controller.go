@@ -0,0 +1,218 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// snapshotPollPeriod is how often the progress of a snapshot is checked.
+// VolumeSnapshots aren't watched so the operator runs without their CRD.
+const snapshotPollPeriod = 5 * time.Second
+
+// volumeSnapshotGVK is the CSI VolumeSnapshot, handled as unstructured
+var volumeSnapshotGVK = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshot"}
+
+// NotebookSnapshotReconciler reconciles a NotebookSnapshot object
+type NotebookSnapshotReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=notebooksnapshots,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=notebooksnapshots/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=notebooksnapshots/finalizers,verbs=update
+// +kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;delete
+
+// Reconcile takes a VolumeSnapshot of the notebook workspace, stopping the
+// notebook meanwhile when requested.
+func (r *NotebookSnapshotReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("notebooksnapshot", req.NamespacedName)
+
+	snapshot := &operatorsv2.NotebookSnapshot{}
+	if err := r.Get(ctx, req.NamespacedName, snapshot); err != nil {
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, nil // Ignore not found error
+		}
+		log.Error(err, "unable to fetch notebook snapshot")
+		return ctrl.Result{}, err
+	}
+
+	if snapshot.Status.Phase == operatorsv2.SnapshotReady || snapshot.Status.Phase == operatorsv2.SnapshotFailed {
+		return ctrl.Result{}, r.releaseNotebook(ctx, snapshot)
+	}
+
+	notebook := &operatorsv2.Jupyter{}
+	if err := r.Get(ctx, types.NamespacedName{Name: snapshot.Spec.Notebook, Namespace: snapshot.Namespace}, notebook); err != nil {
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, r.fail(ctx, snapshot, fmt.Sprintf("notebook %s not found", snapshot.Spec.Notebook))
+		}
+		return ctrl.Result{}, err
+	}
+	if notebook.Spec.Workspace == nil {
+		return ctrl.Result{}, r.fail(ctx, snapshot, fmt.Sprintf("notebook %s has no workspace", notebook.Name))
+	}
+
+	// Wait for the notebook pod to be gone before taking the snapshot
+	if snapshot.Spec.StopNotebook {
+		stopped, err := r.stopNotebook(ctx, snapshot, notebook)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !stopped {
+			return ctrl.Result{RequeueAfter: snapshotPollPeriod}, r.setPhase(ctx, snapshot, operatorsv2.SnapshotStopping)
+		}
+	}
+
+	vs := generateVolumeSnapshot(snapshot, notebook)
+	if err := ctrl.SetControllerReference(snapshot, vs, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Create(ctx, vs); err != nil && !apierrs.IsAlreadyExists(err) {
+		log.Error(err, "unable to create volume snapshot")
+		return ctrl.Result{}, err
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: vs.GetName(), Namespace: vs.GetNamespace()}, vs); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	snapshot.Status.VolumeSnapshotName = vs.GetName()
+	if message, found, _ := unstructured.NestedString(vs.Object, "status", "error", "message"); found {
+		return ctrl.Result{}, r.fail(ctx, snapshot, message)
+	}
+	if ready, _, _ := unstructured.NestedBool(vs.Object, "status", "readyToUse"); !ready {
+		return ctrl.Result{RequeueAfter: snapshotPollPeriod}, r.setPhase(ctx, snapshot, operatorsv2.SnapshotInProgress)
+	}
+
+	log.Info("Snapshot ready", "namespace", snapshot.Namespace, "name", snapshot.Name)
+	now := metav1.Now()
+	snapshot.Status.CompletionTime = &now
+	if err := r.setPhase(ctx, snapshot, operatorsv2.SnapshotReady); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.Recorder.Eventf(snapshot, corev1.EventTypeNormal, "SnapshotReady", "Snapshot of notebook %s is ready", notebook.Name)
+	return ctrl.Result{}, r.releaseNotebook(ctx, snapshot)
+}
+
+// stopNotebook pauses the notebook for the snapshot, and reports whether its
+// pod is gone.
+func (r *NotebookSnapshotReconciler) stopNotebook(ctx context.Context, snapshot *operatorsv2.NotebookSnapshot, notebook *operatorsv2.Jupyter) (bool, error) {
+	holder := notebook.Annotations[operatorsv2.SnapshotAnnotation]
+	if holder != "" && holder != snapshot.Name {
+		// Another snapshot holds the notebook, wait for it to be released,
+		// or to be deleted or done without having released it
+		inProgress, err := snapshotInProgress(ctx, r.Client, notebook.Namespace, holder)
+		if err != nil || inProgress {
+			return false, err
+		}
+		holder = ""
+	}
+	if holder == "" {
+		// Fail rather than race another snapshot taking the notebook
+		patch := client.MergeFromWithOptions(notebook.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		if notebook.Annotations == nil {
+			notebook.Annotations = map[string]string{}
+		}
+		notebook.Annotations[operatorsv2.SnapshotAnnotation] = snapshot.Name
+		if err := r.Patch(ctx, notebook, patch); err != nil {
+			return false, err
+		}
+	}
+
+	pod := &corev1.Pod{}
+	err := r.Get(ctx, types.NamespacedName{Name: notebook.Name + "-0", Namespace: notebook.Namespace}, pod)
+	if apierrs.IsNotFound(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// releaseNotebook lets the notebook run again once the snapshot is done.
+func (r *NotebookSnapshotReconciler) releaseNotebook(ctx context.Context, snapshot *operatorsv2.NotebookSnapshot) error {
+	notebook := &operatorsv2.Jupyter{}
+	if err := r.Get(ctx, types.NamespacedName{Name: snapshot.Spec.Notebook, Namespace: snapshot.Namespace}, notebook); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if notebook.Annotations[operatorsv2.SnapshotAnnotation] != snapshot.Name {
+		return nil
+	}
+	patch := client.MergeFrom(notebook.DeepCopy())
+	delete(notebook.Annotations, operatorsv2.SnapshotAnnotation)
+	return r.Patch(ctx, notebook, patch)
+}
+
+// fail marks the snapshot as failed for a reason retrying won't fix.
+func (r *NotebookSnapshotReconciler) fail(ctx context.Context, snapshot *operatorsv2.NotebookSnapshot, message string) error {
+	r.Recorder.Event(snapshot, corev1.EventTypeWarning, "SnapshotFailed", message)
+	snapshot.Status.Message = message
+	if err := r.setPhase(ctx, snapshot, operatorsv2.SnapshotFailed); err != nil {
+		return err
+	}
+	return r.releaseNotebook(ctx, snapshot)
+}
+
+// setPhase updates the status on phase changes, the other status fields only
+// change along with the phase.
+func (r *NotebookSnapshotReconciler) setPhase(ctx context.Context, snapshot *operatorsv2.NotebookSnapshot, phase operatorsv2.NotebookSnapshotPhase) error {
+	if snapshot.Status.Phase == phase {
+		return nil
+	}
+	snapshot.Status.Phase = phase
+	return r.Status().Update(ctx, snapshot)
+}
+
+func generateVolumeSnapshot(snapshot *operatorsv2.NotebookSnapshot, notebook *operatorsv2.Jupyter) *unstructured.Unstructured {
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": workspaceName(notebook),
+		},
+	}
+	if snapshot.Spec.VolumeSnapshotClassName != nil {
+		spec["volumeSnapshotClassName"] = *snapshot.Spec.VolumeSnapshotClassName
+	}
+
+	vs := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	vs.SetGroupVersionKind(volumeSnapshotGVK)
+	vs.SetName(snapshot.Name)
+	vs.SetNamespace(snapshot.Namespace)
+	return vs
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *NotebookSnapshotReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&operatorsv2.NotebookSnapshot{}).
+		Complete(r)
+}
@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("NotebookSnapshot controller", func() {
+	const (
+		Name      = "snapshot-notebook"
+		Namespace = "default"
+		timeout   = time.Second * 10
+		interval  = time.Millisecond * 250
+	)
+
+	Context("When taking snapshots of a notebook workspace", func() {
+		It("Should provision the workspace of the notebook", func() {
+			ctx := context.Background()
+			notebook := &operatorsv2.Jupyter{
+				ObjectMeta: metav1.ObjectMeta{Name: Name, Namespace: Namespace},
+				Spec: operatorsv2.JupyterSpec{
+					Workspace: &operatorsv2.NotebookWorkspace{Size: resource.MustParse("1Gi")},
+					Template: operatorsv2.JupyterTemplate{
+						Spec: v1.PodSpec{Containers: []v1.Container{{Name: "busybox", Image: "busybox"}}},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, notebook)).Should(Succeed())
+
+			By("By checking the workspace claim is created")
+			pvc := &v1.PersistentVolumeClaim{}
+			Eventually(func() error {
+				return k8sClient.Get(ctx, types.NamespacedName{Name: Name + "-workspace", Namespace: Namespace}, pvc)
+			}, timeout, interval).Should(Succeed())
+			Expect(pvc.Spec.Resources.Requests.Storage().String()).To(Equal("1Gi"))
+		})
+
+		It("Should fail for a notebook without workspace", func() {
+			ctx := context.Background()
+			snapshot := &operatorsv2.NotebookSnapshot{
+				ObjectMeta: metav1.ObjectMeta{Name: "no-workspace", Namespace: Namespace},
+				Spec:       operatorsv2.NotebookSnapshotSpec{Notebook: "test-notebook"},
+			}
+			Expect(k8sClient.Create(ctx, snapshot)).Should(Succeed())
+
+			Eventually(func() operatorsv2.NotebookSnapshotPhase {
+				if err := k8sClient.Get(ctx, types.NamespacedName{Name: "no-workspace", Namespace: Namespace}, snapshot); err != nil {
+					return ""
+				}
+				return snapshot.Status.Phase
+			}, timeout, interval).Should(Equal(operatorsv2.SnapshotFailed))
+			Expect(snapshot.Status.Message).To(ContainSubstring("has no workspace"))
+		})
+
+		It("Should wait for the snapshot to restore a workspace from", func() {
+			ctx := context.Background()
+			notebook := &operatorsv2.Jupyter{
+				ObjectMeta: metav1.ObjectMeta{Name: "restored-notebook", Namespace: Namespace},
+				Spec: operatorsv2.JupyterSpec{
+					Workspace: &operatorsv2.NotebookWorkspace{Size: resource.MustParse("1Gi"), FromSnapshot: "missing"},
+					Template: operatorsv2.JupyterTemplate{
+						Spec: v1.PodSpec{Containers: []v1.Container{{Name: "busybox", Image: "busybox"}}},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, notebook)).Should(Succeed())
+
+			Consistently(func() error {
+				return k8sClient.Get(ctx, types.NamespacedName{Name: "restored-notebook-workspace", Namespace: Namespace}, &v1.PersistentVolumeClaim{})
+			}, time.Second*2, interval).ShouldNot(Succeed())
+		})
+	})
+})
+
+var _ = Describe("NotebookSnapshot holder", func() {
+	newReconciler := func(objs ...runtime.Object) *NotebookSnapshotReconciler {
+		scheme := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+		return &NotebookSnapshotReconciler{
+			Client:   fake.NewFakeClientWithScheme(scheme, objs...),
+			Log:      ctrl.Log.WithName("snapshot-holder"),
+			Scheme:   scheme,
+			Recorder: record.NewFakeRecorder(10),
+		}
+	}
+
+	held := func(holder string) *operatorsv2.Jupyter {
+		return &operatorsv2.Jupyter{ObjectMeta: metav1.ObjectMeta{
+			Name:            "held",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Annotations:     map[string]string{operatorsv2.SnapshotAnnotation: holder},
+		}}
+	}
+	snapshot := func(name string, phase operatorsv2.NotebookSnapshotPhase) *operatorsv2.NotebookSnapshot {
+		return &operatorsv2.NotebookSnapshot{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       operatorsv2.NotebookSnapshotSpec{Notebook: "held", StopNotebook: true},
+			Status:     operatorsv2.NotebookSnapshotStatus{Phase: phase},
+		}
+	}
+
+	It("Should wait for a snapshot in progress to release the notebook", func() {
+		notebook := held("first")
+		r := newReconciler(notebook, snapshot("first", operatorsv2.SnapshotStopping))
+		stopped, err := r.stopNotebook(context.Background(), snapshot("second", ""), notebook)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stopped).To(BeFalse())
+		Expect(notebook.Annotations).To(HaveKeyWithValue(operatorsv2.SnapshotAnnotation, "first"))
+	})
+
+	It("Should take over a notebook held by a deleted or finished snapshot", func() {
+		for _, holder := range []*operatorsv2.NotebookSnapshot{nil, snapshot("first", operatorsv2.SnapshotReady)} {
+			notebook := held("first")
+			objs := []runtime.Object{notebook}
+			if holder != nil {
+				objs = append(objs, holder)
+			}
+			r := newReconciler(objs...)
+			key := types.NamespacedName{Name: "held", Namespace: "default"}
+			Expect(r.Get(context.Background(), key, notebook)).To(Succeed())
+			stopped, err := r.stopNotebook(context.Background(), snapshot("second", ""), notebook)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stopped).To(BeTrue())
+
+			current := &operatorsv2.Jupyter{}
+			Expect(r.Get(context.Background(), key, current)).To(Succeed())
+			Expect(current.Annotations).To(HaveKeyWithValue(operatorsv2.SnapshotAnnotation, "second"))
+		}
+	})
+})
+
+var _ = Describe("Workspace reclaim policy", func() {
+	notebook := &operatorsv2.Jupyter{ObjectMeta: metav1.ObjectMeta{Name: "kept", Namespace: "default", UID: "kept-uid"}}
+
+	newReconciler := func(pvc *v1.PersistentVolumeClaim) *JupyterReconciler {
+		scheme := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+		return &JupyterReconciler{
+			Client: fake.NewFakeClientWithScheme(scheme, pvc),
+			Scheme: scheme,
+		}
+	}
+	workspace := func() *v1.PersistentVolumeClaim {
+		return &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Name:      "kept-workspace",
+			Namespace: "default",
+			Labels:    map[string]string{"notebook-name": "kept"},
+		}}
+	}
+
+	It("Should stop owning a retained workspace and own it again otherwise", func() {
+		pvc := workspace()
+		r := newReconciler(pvc)
+		Expect(r.reclaimWorkspace(context.Background(), notebook, pvc, false)).To(Succeed())
+		Expect(metav1.IsControlledBy(pvc, notebook)).To(BeTrue())
+
+		Expect(r.reclaimWorkspace(context.Background(), notebook, pvc, true)).To(Succeed())
+		Expect(pvc.OwnerReferences).To(BeEmpty())
+	})
+
+	It("Should not take over a claim it didn't generate", func() {
+		pvc := workspace()
+		pvc.Labels = nil
+		r := newReconciler(pvc)
+		Expect(r.reclaimWorkspace(context.Background(), notebook, pvc, false)).To(Succeed())
+		Expect(pvc.OwnerReferences).To(BeEmpty())
+	})
+})
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// desiredStatefulSet returns the StatefulSet of a notebook with the
+// controller-wide defaults applied, annotated with the hash of its template.
+// image, resolved from the NotebookImage catalog, replaces the image of the
+// notebook container when set. daskTLS mounts the client configuration of
+// the referenced Dask cluster, which only exists while its TLS is enabled.
+func desiredStatefulSet(instance *operatorsv2.Jupyter, replicas int32, image string, daskTLS bool, config configv1alpha1.NotebookConfig) *appsv1.StatefulSet {
+	ss := generateStatefulSet(instance, replicas)
+	if image != "" {
+		ss.Spec.Template.Spec.Containers[0].Image = image
+	}
+	if daskTLS && instance.Spec.DaskRef != nil {
+		mountDaskConfig(&ss.Spec.Template.Spec, daskClientSecretName(instance.Spec.DaskRef.Name), true)
+	}
+	ApplyContainerDefaults(&ss.Spec.Template.Spec.Containers[0], config.DefaultImage, config.DefaultResources)
+	ss.Annotations = map[string]string{templateHashAnnotation: templateHash(&ss.Spec.Template)}
+	return ss
+}
+
+// desiredSchedulerDeployment returns the scheduler Deployment of a Dask
+// cluster with the controller-wide defaults applied.
+func desiredSchedulerDeployment(instance *operatorsv2.Dask, config configv1alpha1.DaskConfig) *appsv1.Deployment {
+	scheduler := generateSchedulerDeployment(instance, daskDashboardPrefix(instance, config))
+	ApplyContainerDefaults(&scheduler.Spec.Template.Spec.Containers[0], "", config.DefaultResources)
+	return scheduler
+}
+
+// desiredWorkerDeployment returns the Deployment of a worker group of a Dask
+// cluster with the controller-wide defaults applied.
+func desiredWorkerDeployment(instance *operatorsv2.Dask, group *operatorsv2.DaskWorkerGroup, config configv1alpha1.DaskConfig) *appsv1.Deployment {
+	worker := generateWorkerDeployment(instance, group)
+	ApplyContainerDefaults(&worker.Spec.Template.Spec.Containers[0], "", config.DefaultResources)
+	return worker
+}
+
+// RenderConfig holds the settings the objects are rendered with
+type RenderConfig struct {
+	Notebook configv1alpha1.NotebookConfig
+	Dask     configv1alpha1.DaskConfig
+}
+
+// RenderJupyter returns the objects the Jupyter controller generates for a
+// notebook. The notebook is rendered running and in use unless it is
+// annotated as stopped, its schedule and NotebookImage are not evaluated,
+// and the TLS configuration of its Dask cluster isn't mounted. The Secret of
+// its token isn't rendered, as the token is generated when it is created.
+func RenderJupyter(instance *operatorsv2.Jupyter, config configv1alpha1.NotebookConfig) []client.Object {
+	replicas := int32(1)
+	if _, stopped := instance.Annotations[operatorsv2.StoppedAnnotation]; stopped {
+		replicas = 0
+	}
+
+	objs := []client.Object{
+		desiredStatefulSet(instance, replicas, "", false, config),
+		generateService(instance),
+	}
+	if replicas > 0 {
+		objs = append(objs, generateNotebookPDB(instance))
+	}
+	if instance.Spec.Isolation {
+		objs = append(objs, generateNetworkPolicy(instance, config.NetworkPolicy))
+	}
+	if instance.Spec.ServiceAccount != nil {
+		objs = append(objs, generateServiceAccount(instance), generateRoleBinding(instance))
+	}
+	if instance.Spec.Workspace != nil {
+		objs = append(objs, generateWorkspacePVC(instance))
+	}
+	return objs
+}
+
+// RenderDask returns the objects the Dask controller generates for a cluster.
+// The cluster is rendered in use unless it is annotated as stopped.
+func RenderDask(instance *operatorsv2.Dask, config configv1alpha1.DaskConfig) []client.Object {
+	objs := []client.Object{
+		desiredSchedulerDeployment(instance, config),
+		generateSchedulerService(instance),
+	}
+	if _, stopped := instance.Annotations[operatorsv2.StoppedAnnotation]; !stopped {
+		objs = append(objs, generateSchedulerPDB(instance))
+	}
+	groups := instance.EffectiveWorkerGroups()
+	for i := range groups {
+		objs = append(objs, desiredWorkerDeployment(instance, &groups[i], config))
+		if instance.Spec.WorkerMinAvailable != nil {
+			objs = append(objs, generateWorkerPDB(instance, &groups[i]))
+		}
+	}
+	if config.DashboardIngress != nil {
+		objs = append(objs, generateDashboardIngress(instance, config))
+	}
+	return objs
+}
+
+// Render reads Jupyter and Dask manifests from r and writes the objects the
+// controllers generate for them to w, as a YAML stream.
+func Render(r io.Reader, w io.Writer, scheme *runtime.Scheme, config RenderConfig) error {
+	decoder := serializer.NewCodecFactory(scheme).UniversalDeserializer()
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		obj, gvk, err := decoder.Decode(doc, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		var owner client.Object
+		var objs []client.Object
+		switch instance := obj.(type) {
+		case *operatorsv2.Jupyter:
+			if len(instance.Spec.Template.Spec.Containers) == 0 {
+				return fmt.Errorf("jupyter %s has no container", instance.Name)
+			}
+			owner, objs = instance, RenderJupyter(instance, config.Notebook)
+		case *operatorsv2.Dask:
+			if len(instance.Spec.SchedulerTemplate.Spec.Containers) == 0 {
+				return fmt.Errorf("dask %s has no scheduler container", instance.Name)
+			}
+			for _, group := range instance.EffectiveWorkerGroups() {
+				if len(group.Template.Spec.Containers) == 0 {
+					return fmt.Errorf("dask %s has no worker container", instance.Name)
+				}
+			}
+			owner, objs = instance, RenderDask(instance, config.Dask)
+		default:
+			return fmt.Errorf("cannot render a %s, only Jupyter and Dask are supported", gvk.Kind)
+		}
+
+		for _, o := range objs {
+			if err = ctrl.SetControllerReference(owner, o, scheme); err != nil {
+				return err
+			}
+			out, err := yaml.Marshal(o)
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(w, "---\n%s", out); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"bytes"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+)
+
+var _ = Describe("Render", func() {
+	It("Should print the objects generated for each manifest", func() {
+		manifests := `
+apiVersion: operators.convect.ai/v2
+kind: Jupyter
+metadata:
+  name: render-notebook
+  namespace: default
+spec:
+  isolation: true
+  template:
+    spec:
+      containers:
+      - name: notebook
+---
+apiVersion: operators.convect.ai/v2
+kind: Dask
+metadata:
+  name: render-dask
+  namespace: default
+spec:
+  schedulerTemplate:
+    spec:
+      containers:
+      - name: scheduler
+        image: daskdev/dask
+  workerTemplate:
+    spec:
+      containers:
+      - name: worker
+        image: daskdev/dask
+`
+		config := RenderConfig{}
+		config.Notebook.DefaultImage = "jupyter/minimal-notebook"
+
+		out := &bytes.Buffer{}
+		Expect(Render(strings.NewReader(manifests), out, scheme.Scheme, config)).Should(Succeed())
+		Expect(out.String()).To(ContainSubstring("kind: StatefulSet"))
+		Expect(out.String()).To(ContainSubstring("kind: NetworkPolicy"))
+		Expect(out.String()).To(ContainSubstring("image: jupyter/minimal-notebook"))
+		Expect(out.String()).To(ContainSubstring("name: render-dask-worker"))
+		Expect(out.String()).To(ContainSubstring("kind: PodDisruptionBudget"))
+		Expect(strings.Count(out.String(), "---\n")).To(Equal(8))
+	})
+
+	It("Should expose the Dask dashboard under its prefix", func() {
+		manifest := `
+apiVersion: operators.convect.ai/v2
+kind: Dask
+metadata:
+  name: exposed-dask
+  namespace: team
+spec:
+  schedulerTemplate:
+    spec:
+      containers:
+      - name: scheduler
+  workerTemplate:
+    spec:
+      containers:
+      - name: worker
+`
+		config := RenderConfig{}
+		config.Dask.DashboardIngress = &configv1alpha1.DashboardIngressConfig{Host: "dask.example.com", TLSSecretName: "dask-tls"}
+
+		out := &bytes.Buffer{}
+		Expect(Render(strings.NewReader(manifest), out, scheme.Scheme, config)).Should(Succeed())
+		Expect(out.String()).To(ContainSubstring("kind: Ingress"))
+		Expect(out.String()).To(ContainSubstring("path: /dask/team/exposed-dask"))
+		Expect(out.String()).To(ContainSubstring("- --dashboard-prefix\n        - /dask/team/exposed-dask"))
+	})
+
+	It("Should reject other kinds", func() {
+		manifest := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: other\n"
+		Expect(Render(strings.NewReader(manifest), &bytes.Buffer{}, scheme.Scheme, RenderConfig{})).ShouldNot(Succeed())
+	})
+})
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// scheduleLookback bounds how far back the last stop and start are searched
+// for, which covers any weekly schedule.
+const scheduleLookback = 8 * 24 * time.Hour
+
+// evaluateSchedule reports whether the schedule keeps the notebook stopped at
+// now, and when the schedule next flips the notebook state.
+func evaluateSchedule(schedule *operatorsv2.NotebookSchedule, now time.Time) (bool, time.Time, error) {
+	loc := time.UTC
+	if schedule.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(schedule.TimeZone); err != nil {
+			return false, time.Time{}, err
+		}
+	}
+	now = now.In(loc)
+
+	stop, err := cron.ParseStandard(schedule.Stop)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	start, err := cron.ParseStandard(schedule.Start)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	// The notebook is stopped when the last stop happened after the last start
+	lastStop := lastActivation(stop, now)
+	lastStart := lastActivation(start, now)
+	stopped := !lastStop.IsZero() && lastStop.After(lastStart)
+
+	next := stop.Next(now)
+	if nextStart := start.Next(now); nextStart.Before(next) {
+		next = nextStart
+	}
+	return stopped, next, nil
+}
+
+// lastActivation returns the latest activation of sched not after now, or the
+// zero time when it did not fire within scheduleLookback. The window searched
+// widens back from now, so that frequent schedules only walk a few
+// activations.
+func lastActivation(sched cron.Schedule, now time.Time) time.Time {
+	for window := time.Minute; ; window *= 2 {
+		if window > scheduleLookback {
+			window = scheduleLookback
+		}
+		var last time.Time
+		for t := sched.Next(now.Add(-window)); !t.IsZero() && !t.After(now); t = sched.Next(t) {
+			last = t
+		}
+		if !last.IsZero() || window == scheduleLookback {
+			return last
+		}
+	}
+}
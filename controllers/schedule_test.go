@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/robfig/cron/v3"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("Notebook schedule", func() {
+	// Stop weekdays at 20:00 and start weekdays at 08:00
+	schedule := &operatorsv2.NotebookSchedule{
+		Stop:     "0 20 * * 1-5",
+		Start:    "0 8 * * 1-5",
+		TimeZone: "Europe/Berlin",
+	}
+
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+
+	It("Should keep the notebook running during working hours", func() {
+		now := time.Date(2021, time.June, 2, 12, 0, 0, 0, berlin) // Wednesday
+		stopped, next, err := evaluateSchedule(schedule, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stopped).To(BeFalse())
+		Expect(next.Equal(time.Date(2021, time.June, 2, 20, 0, 0, 0, berlin))).To(BeTrue())
+	})
+
+	It("Should stop the notebook overnight", func() {
+		now := time.Date(2021, time.June, 2, 23, 0, 0, 0, berlin)
+		stopped, next, err := evaluateSchedule(schedule, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stopped).To(BeTrue())
+		Expect(next.Equal(time.Date(2021, time.June, 3, 8, 0, 0, 0, berlin))).To(BeTrue())
+	})
+
+	It("Should keep the notebook stopped over the weekend", func() {
+		now := time.Date(2021, time.June, 5, 12, 0, 0, 0, berlin) // Saturday
+		stopped, next, err := evaluateSchedule(schedule, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stopped).To(BeTrue())
+		Expect(next.Equal(time.Date(2021, time.June, 7, 8, 0, 0, 0, berlin))).To(BeTrue())
+	})
+
+	It("Should evaluate the expressions in the schedule time zone", func() {
+		now := time.Date(2021, time.June, 2, 19, 30, 0, 0, time.UTC) // 21:30 in Berlin
+		stopped, _, err := evaluateSchedule(schedule, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stopped).To(BeTrue())
+	})
+
+	It("Should only walk a few activations of a frequent schedule", func() {
+		every, err := cron.ParseStandard("* * * * *")
+		Expect(err).NotTo(HaveOccurred())
+		sched := &countingSchedule{Schedule: every}
+		now := time.Date(2021, time.June, 2, 12, 0, 30, 0, time.UTC)
+		Expect(lastActivation(sched, now)).To(Equal(time.Date(2021, time.June, 2, 12, 0, 0, 0, time.UTC)))
+		Expect(sched.calls).To(BeNumerically("<", 10))
+	})
+
+	It("Should find the last activation of a weekly schedule", func() {
+		weekly, err := cron.ParseStandard("0 8 * * 1")
+		Expect(err).NotTo(HaveOccurred())
+		now := time.Date(2021, time.June, 6, 12, 0, 0, 0, time.UTC) // Sunday
+		Expect(lastActivation(weekly, now)).To(Equal(time.Date(2021, time.May, 31, 8, 0, 0, 0, time.UTC)))
+	})
+
+	It("Should reject invalid expressions", func() {
+		_, _, err := evaluateSchedule(&operatorsv2.NotebookSchedule{Stop: "tonight", Start: "0 8 * * *"}, time.Now())
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+// countingSchedule counts the activations computed by a schedule
+type countingSchedule struct {
+	cron.Schedule
+	calls int
+}
+
+func (s *countingSchedule) Next(t time.Time) time.Time {
+	s.calls++
+	return s.Schedule.Next(t)
+}
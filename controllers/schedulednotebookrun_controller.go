@@ -0,0 +1,274 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// ScheduledNotebookRunReconciler reconciles a ScheduledNotebookRun object
+type ScheduledNotebookRunReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=schedulednotebookruns,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=schedulednotebookruns/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=operators.convect.ai,resources=schedulednotebookruns/finalizers,verbs=update
+
+// Reconcile creates the NotebookRuns of a ScheduledNotebookRun when they are
+// due, and prunes the finished ones beyond the history limits.
+func (r *ScheduledNotebookRunReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("schedulednotebookrun", req.NamespacedName)
+
+	scheduled := &operatorsv2.ScheduledNotebookRun{}
+	if err := r.Get(ctx, req.NamespacedName, scheduled); err != nil {
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, nil // Ignore not found error
+		}
+		log.Error(err, "unable to fetch scheduled notebook run")
+		return ctrl.Result{}, err
+	}
+	oldStatus := scheduled.Status.DeepCopy()
+
+	runs := &operatorsv2.NotebookRunList{}
+	if err := r.List(ctx, runs, client.InNamespace(scheduled.Namespace), client.MatchingLabels{"scheduled-notebook-run": scheduled.Name}); err != nil {
+		return ctrl.Result{}, err
+	}
+	var active, succeeded, failed []*operatorsv2.NotebookRun
+	for i := range runs.Items {
+		run := &runs.Items[i]
+		if !metav1.IsControlledBy(run, scheduled) {
+			continue
+		}
+		switch run.Status.Phase {
+		case operatorsv2.RunSucceeded:
+			succeeded = append(succeeded, run)
+		case operatorsv2.RunFailed:
+			failed = append(failed, run)
+		default:
+			active = append(active, run)
+		}
+	}
+
+	scheduled.Status.Active = nil
+	for _, run := range active {
+		scheduled.Status.Active = append(scheduled.Status.Active, run.Name)
+	}
+	scheduled.Status.LastSuccessfulRun = lastRun(scheduled.Status.LastSuccessfulRun, succeeded)
+	scheduled.Status.LastFailedRun = lastRun(scheduled.Status.LastFailedRun, failed)
+
+	if err := r.pruneRuns(ctx, succeeded, historyLimit(scheduled.Spec.SuccessfulRunsHistoryLimit, 3)); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.pruneRuns(ctx, failed, historyLimit(scheduled.Spec.FailedRunsHistoryLimit, 1)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	result := ctrl.Result{}
+	if !scheduled.Spec.Suspend {
+		now := time.Now()
+		due, next, err := dueRun(scheduled, now)
+		if err != nil {
+			// Retrying won't fix the expression, wait for the spec to change
+			r.Recorder.Eventf(scheduled, corev1.EventTypeWarning, "InvalidSchedule", "Invalid schedule: %v", err)
+			return ctrl.Result{}, r.updateStatus(ctx, scheduled, oldStatus)
+		}
+		result.RequeueAfter = next.Sub(now)
+
+		if !due.IsZero() {
+			if err := r.startRun(ctx, scheduled, active, due); err != nil {
+				return ctrl.Result{}, err
+			}
+			dueTime := metav1.NewTime(due)
+			scheduled.Status.LastScheduleTime = &dueTime
+		}
+	}
+
+	return result, r.updateStatus(ctx, scheduled, oldStatus)
+}
+
+// startRun creates the run due at the given time, applying the concurrency
+// policy to the active runs.
+func (r *ScheduledNotebookRunReconciler) startRun(ctx context.Context, scheduled *operatorsv2.ScheduledNotebookRun, active []*operatorsv2.NotebookRun, due time.Time) error {
+	log := r.Log.WithValues("schedulednotebookrun", client.ObjectKeyFromObject(scheduled))
+
+	if len(active) > 0 {
+		switch scheduled.Spec.ConcurrencyPolicy {
+		case operatorsv2.AllowConcurrent:
+		case operatorsv2.ReplaceConcurrent:
+			for _, run := range active {
+				log.Info("Replacing active run", "name", run.Name)
+				if err := r.Delete(ctx, run, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+					return err
+				}
+			}
+			scheduled.Status.Active = nil
+		default:
+			r.Recorder.Eventf(scheduled, corev1.EventTypeNormal, "RunSkipped", "Skipped the run due at %s, %s is still active", due.Format(time.RFC3339), active[0].Name)
+			return nil
+		}
+	}
+
+	run := generateScheduledRun(scheduled, due)
+	if err := ctrl.SetControllerReference(scheduled, run, r.Scheme); err != nil {
+		return err
+	}
+	log.Info("Creating NotebookRun", "namespace", run.Namespace, "name", run.Name)
+	if err := r.Create(ctx, run); err != nil {
+		if apierrs.IsAlreadyExists(err) {
+			return nil
+		}
+		log.Error(err, "unable to create notebook run")
+		return err
+	}
+	r.Recorder.Eventf(scheduled, corev1.EventTypeNormal, "RunCreated", "Created notebook run %s", run.Name)
+	scheduled.Status.Active = append(scheduled.Status.Active, run.Name)
+	return nil
+}
+
+// pruneRuns deletes the oldest finished runs beyond limit.
+func (r *ScheduledNotebookRunReconciler) pruneRuns(ctx context.Context, runs []*operatorsv2.NotebookRun, limit int) error {
+	if len(runs) <= limit {
+		return nil
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].CreationTimestamp.Before(&runs[j].CreationTimestamp)
+	})
+	for _, run := range runs[:len(runs)-limit] {
+		if err := r.Delete(ctx, run, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ScheduledNotebookRunReconciler) updateStatus(ctx context.Context, scheduled *operatorsv2.ScheduledNotebookRun, oldStatus *operatorsv2.ScheduledNotebookRunStatus) error {
+	if reflect.DeepEqual(oldStatus, &scheduled.Status) {
+		return nil
+	}
+	return r.Status().Update(ctx, scheduled)
+}
+
+// historyLimit returns the value of a history limit, or its default.
+func historyLimit(limit *int32, defaultLimit int) int {
+	if limit == nil {
+		return defaultLimit
+	}
+	return int(*limit)
+}
+
+// lastRun returns the most recently completed of the runs, unless last
+// completed later. Pruned runs are still reported through last.
+func lastRun(last *operatorsv2.RunReference, runs []*operatorsv2.NotebookRun) *operatorsv2.RunReference {
+	for _, run := range runs {
+		completionTime := run.Status.CompletionTime
+		if completionTime == nil {
+			continue
+		}
+		if last != nil && last.CompletionTime != nil && !last.CompletionTime.Before(completionTime) {
+			continue
+		}
+		last = &operatorsv2.RunReference{
+			Name:           run.Name,
+			CompletionTime: completionTime,
+			Reason:         run.Status.Reason,
+		}
+	}
+	return last
+}
+
+// dueRun returns the latest time a run was due at since the last scheduled
+// one, or the zero time when none is due at now, and when the next run is due.
+func dueRun(scheduled *operatorsv2.ScheduledNotebookRun, now time.Time) (time.Time, time.Time, error) {
+	loc := time.UTC
+	if scheduled.Spec.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(scheduled.Spec.TimeZone); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	now = now.In(loc)
+
+	sched, err := cron.ParseStandard(scheduled.Spec.Schedule)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	earliest := scheduled.CreationTimestamp.Time
+	if scheduled.Status.LastScheduleTime != nil {
+		earliest = scheduled.Status.LastScheduleTime.Time
+	}
+	if lookback := now.Add(-scheduleLookback); earliest.Before(lookback) {
+		earliest = lookback
+	}
+	if deadline := scheduled.Spec.StartingDeadlineSeconds; deadline != nil {
+		if start := now.Add(-time.Duration(*deadline) * time.Second); earliest.Before(start) {
+			earliest = start
+		}
+	}
+
+	var due time.Time
+	for t := sched.Next(earliest.In(loc)); !t.After(now); t = sched.Next(t) {
+		due = t
+	}
+	return due, sched.Next(now), nil
+}
+
+// generateScheduledRun returns the run due at the given time. Its name
+// derives from that time, so that a run is created once.
+func generateScheduledRun(scheduled *operatorsv2.ScheduledNotebookRun, due time.Time) *operatorsv2.NotebookRun {
+	return &operatorsv2.NotebookRun{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%d", scheduled.Name, due.Unix()/60),
+			Namespace: scheduled.Namespace,
+			Labels: map[string]string{
+				"scheduled-notebook-run": scheduled.Name,
+			},
+			Annotations: map[string]string{
+				operatorsv2.ScheduledAtAnnotation: due.UTC().Format(time.RFC3339),
+			},
+		},
+		Spec: *scheduled.Spec.RunTemplate.DeepCopy(),
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ScheduledNotebookRunReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&operatorsv2.ScheduledNotebookRun{}).
+		Owns(&operatorsv2.NotebookRun{}).
+		Complete(r)
+}
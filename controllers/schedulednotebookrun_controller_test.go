@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("Scheduled notebook run", func() {
+	created := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+	newScheduled := func() *operatorsv2.ScheduledNotebookRun {
+		return &operatorsv2.ScheduledNotebookRun{
+			ObjectMeta: metav1.ObjectMeta{Name: "daily", CreationTimestamp: metav1.NewTime(created)},
+			Spec:       operatorsv2.ScheduledNotebookRunSpec{Schedule: "0 6 * * *"},
+		}
+	}
+
+	It("Should not run before the first activation", func() {
+		due, next, err := dueRun(newScheduled(), created.Add(time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(due.IsZero()).To(BeTrue())
+		Expect(next.Equal(time.Date(2021, time.June, 2, 6, 0, 0, 0, time.UTC))).To(BeTrue())
+	})
+
+	It("Should run once for the latest missed activation", func() {
+		scheduled := newScheduled()
+		lastSchedule := metav1.NewTime(time.Date(2021, time.June, 2, 6, 0, 0, 0, time.UTC))
+		scheduled.Status.LastScheduleTime = &lastSchedule
+
+		due, _, err := dueRun(scheduled, time.Date(2021, time.June, 4, 7, 0, 0, 0, time.UTC))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(due.Equal(time.Date(2021, time.June, 4, 6, 0, 0, 0, time.UTC))).To(BeTrue())
+	})
+
+	It("Should skip runs missed beyond the starting deadline", func() {
+		scheduled := newScheduled()
+		deadline := int64(600)
+		scheduled.Spec.StartingDeadlineSeconds = &deadline
+
+		due, _, err := dueRun(scheduled, time.Date(2021, time.June, 2, 7, 0, 0, 0, time.UTC))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(due.IsZero()).To(BeTrue())
+	})
+
+	It("Should name runs after their due time", func() {
+		run := generateScheduledRun(newScheduled(), time.Date(2021, time.June, 2, 6, 0, 0, 0, time.UTC))
+		Expect(run.Name).To(Equal("daily-27043560"))
+		Expect(run.Labels).To(HaveKeyWithValue("scheduled-notebook-run", "daily"))
+		Expect(run.Annotations).To(HaveKeyWithValue(operatorsv2.ScheduledAtAnnotation, "2021-06-02T06:00:00Z"))
+	})
+
+	It("Should keep the last run through pruning", func() {
+		earlier, later := metav1.NewTime(created), metav1.NewTime(created.Add(time.Hour))
+		last := &operatorsv2.RunReference{Name: "pruned", CompletionTime: &later}
+		runs := []*operatorsv2.NotebookRun{{
+			ObjectMeta: metav1.ObjectMeta{Name: "older"},
+			Status:     operatorsv2.NotebookRunStatus{CompletionTime: &earlier},
+		}}
+		Expect(lastRun(last, runs).Name).To(Equal("pruned"))
+		Expect(lastRun(nil, runs).Name).To(Equal("older"))
+	})
+})
@@ -31,6 +31,7 @@ import (
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
 	operatorsv2 "convect.ai/notebook-crd/api/v2"
 	//+kubebuilder:scaffold:imports
 )
@@ -86,6 +87,46 @@ var _ = BeforeSuite(func() {
 		Log:      ctrl.Log.WithName("controller").WithName("notebook-controller"),
 		Scheme:   k8sManager.GetScheme(),
 		Recorder: k8sManager.GetEventRecorderFor("notebook-controller"),
+		Config:   configv1alpha1.NotebookConfig{ServiceAccountClusterRoles: []string{"view"}},
+	}).SetupWithManager(k8sManager)
+	Expect(err).NotTo(HaveOccurred())
+
+	err = (&DaskReconciler{
+		Client:   k8sManager.GetClient(),
+		Log:      ctrl.Log.WithName("controller").WithName("dask-controller"),
+		Scheme:   k8sManager.GetScheme(),
+		Recorder: k8sManager.GetEventRecorderFor("dask-controller"),
+	}).SetupWithManager(k8sManager)
+	Expect(err).NotTo(HaveOccurred())
+
+	err = (&NotebookSnapshotReconciler{
+		Client:   k8sManager.GetClient(),
+		Log:      ctrl.Log.WithName("controller").WithName("notebooksnapshot-controller"),
+		Scheme:   k8sManager.GetScheme(),
+		Recorder: k8sManager.GetEventRecorderFor("notebooksnapshot-controller"),
+	}).SetupWithManager(k8sManager)
+	Expect(err).NotTo(HaveOccurred())
+
+	err = (&NotebookRunReconciler{
+		Client:   k8sManager.GetClient(),
+		Log:      ctrl.Log.WithName("controller").WithName("notebookrun-controller"),
+		Scheme:   k8sManager.GetScheme(),
+		Recorder: k8sManager.GetEventRecorderFor("notebookrun-controller"),
+	}).SetupWithManager(k8sManager)
+	Expect(err).NotTo(HaveOccurred())
+
+	err = (&ScheduledNotebookRunReconciler{
+		Client:   k8sManager.GetClient(),
+		Log:      ctrl.Log.WithName("controller").WithName("schedulednotebookrun-controller"),
+		Scheme:   k8sManager.GetScheme(),
+		Recorder: k8sManager.GetEventRecorderFor("schedulednotebookrun-controller"),
+	}).SetupWithManager(k8sManager)
+	Expect(err).NotTo(HaveOccurred())
+
+	err = (&NotebookImageReconciler{
+		Client: k8sManager.GetClient(),
+		Log:    ctrl.Log.WithName("controller").WithName("notebookimage-controller"),
+		Scheme: k8sManager.GetScheme(),
 	}).SetupWithManager(k8sManager)
 	Expect(err).NotTo(HaveOccurred())
 
@@ -17,22 +17,37 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv1 "convect.ai/notebook-crd/api/v1"
 	operatorsv2 "convect.ai/notebook-crd/api/v2"
 	"convect.ai/notebook-crd/controllers"
+	"convect.ai/notebook-crd/webhooks"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -41,22 +56,53 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
+	utilruntime.Must(operatorsv1.AddToScheme(scheme))
 	utilruntime.Must(operatorsv2.AddToScheme(scheme))
+	utilruntime.Must(configv1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		if err := render(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var configFile string
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var ingressNamespaceSelector string
+	var authProxySelector string
+	var egressCIDRs string
+	var namespaces string
+	var namespaceSelector string
+	flag.StringVar(&configFile, "config", "",
+		"The operator will load its initial configuration from this file. "+
+			"The other flags given override its settings.")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&ingressNamespaceSelector, "ingress-namespace-selector", "",
+		"Label selector of the namespaces allowed to reach isolated notebooks, e.g. the ingress controller's.")
+	flag.StringVar(&authProxySelector, "auth-proxy-selector", "",
+		"Label selector of the auth proxy pods allowed to reach isolated notebooks.")
+	flag.StringVar(&egressCIDRs, "egress-cidrs", "",
+		"Comma-separated CIDRs isolated notebooks may reach in addition to DNS and their Dask scheduler.")
+	flag.StringVar(&namespaces, "namespaces", "",
+		"Comma-separated namespaces the operator is restricted to. All namespaces are watched by default.")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "",
+		"Label selector of additional namespaces the operator is restricted to, resolved at startup.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -65,34 +111,175 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "8afca3bb.convect.ai",
-	})
+	var err error
+	operatorConfig := configv1alpha1.OperatorConfig{}
+	options := ctrl.Options{Scheme: scheme}
+	if configFile != "" {
+		options, err = options.AndFrom(ctrl.ConfigFile().AtPath(configFile).OfKind(&operatorConfig))
+		if err != nil {
+			setupLog.Error(err, "unable to load the config file")
+			os.Exit(1)
+		}
+	} else {
+		options.Port = 9443
+		options.LeaderElectionID = "8afca3bb.convect.ai"
+	}
+
+	// The flags given on the command line override the config file, the
+	// defaults of the others only apply without one
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	override := func(name string) bool {
+		return configFile == "" || given[name]
+	}
+	if override("metrics-bind-address") {
+		options.MetricsBindAddress = metricsAddr
+	}
+	if override("health-probe-bind-address") {
+		options.HealthProbeBindAddress = probeAddr
+	}
+	if override("leader-elect") {
+		options.LeaderElection = enableLeaderElection
+	}
+
+	networkPolicy, err := parseNetworkPolicyConfig(ingressNamespaceSelector, authProxySelector, egressCIDRs)
+	if err != nil {
+		setupLog.Error(err, "invalid network policy options")
+		os.Exit(1)
+	}
+	if override("ingress-namespace-selector") {
+		operatorConfig.Notebook.NetworkPolicy.IngressNamespaceSelector = networkPolicy.IngressNamespaceSelector
+	}
+	if override("auth-proxy-selector") {
+		operatorConfig.Notebook.NetworkPolicy.AuthProxySelector = networkPolicy.AuthProxySelector
+	}
+	if override("egress-cidrs") {
+		operatorConfig.Notebook.NetworkPolicy.EgressCIDRs = networkPolicy.EgressCIDRs
+	}
+
+	if override("namespaces") {
+		operatorConfig.Namespaces = splitList(namespaces)
+	}
+	if override("namespace-selector") {
+		operatorConfig.NamespaceSelector = nil
+		if namespaceSelector != "" {
+			if operatorConfig.NamespaceSelector, err = metav1.ParseToLabelSelector(namespaceSelector); err != nil {
+				setupLog.Error(err, "invalid namespace selector")
+				os.Exit(1)
+			}
+		}
+	}
+	if err = validateNetworkPolicyConfig(operatorConfig.Notebook.NetworkPolicy); err != nil {
+		setupLog.Error(err, "invalid network policy options")
+		os.Exit(1)
+	}
+
+	restConfig := ctrl.GetConfigOrDie()
+	watched, err := watchedNamespaces(restConfig, operatorConfig)
+	if err != nil {
+		setupLog.Error(err, "unable to resolve the watched namespaces")
+		os.Exit(1)
+	}
+	switch len(watched) {
+	case 0:
+		setupLog.Info("watching all namespaces")
+	case 1:
+		setupLog.Info("watching a single namespace", "namespace", watched[0])
+		options.Namespace = watched[0]
+	default:
+		setupLog.Info("watching multiple namespaces", "namespaces", watched)
+		options.NewCache = cache.MultiNamespacedCacheBuilder(watched)
+		// That cache can't get cluster-scoped objects
+		options.ClientDisableCacheFor = []client.Object{&operatorsv2.NotebookImage{}}
+	}
+
+	mgr, err := ctrl.NewManager(restConfig, options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
 	if err = (&controllers.JupyterReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("Jupyter"),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("Jupyter"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("jupyter-controller"),
+
+		Config: operatorConfig.Notebook,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Jupyter")
 		os.Exit(1)
 	}
 	if err = (&controllers.DaskReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("Dask"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("dask-controller"),
+
+		Config: operatorConfig.Dask,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Dask")
 		os.Exit(1)
 	}
+	if err = (&controllers.NotebookSnapshotReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("NotebookSnapshot"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("notebooksnapshot-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "NotebookSnapshot")
+		os.Exit(1)
+	}
+	if err = (&controllers.NotebookRunReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("NotebookRun"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("notebookrun-controller"),
+
+		Config: operatorConfig.Notebook,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "NotebookRun")
+		os.Exit(1)
+	}
+	if err = (&controllers.ScheduledNotebookRunReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("ScheduledNotebookRun"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("schedulednotebookrun-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ScheduledNotebookRun")
+		os.Exit(1)
+	}
+	// The catalog is cluster-scoped, an operator restricted to some namespaces
+	// would count only their notebooks in the status of the entries
+	if len(watched) == 0 {
+		if err = (&controllers.NotebookImageReconciler{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("NotebookImage"),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "NotebookImage")
+			os.Exit(1)
+		}
+	} else {
+		setupLog.Info("not reporting the NotebookImage status, it is left to an operator watching all namespaces")
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&operatorsv2.Jupyter{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Jupyter")
+			os.Exit(1)
+		}
+		mgr.GetWebhookServer().Register(webhooks.CreatorPath, &webhook.Admission{Handler: &webhooks.CreatorAnnotator{}})
+		mgr.GetWebhookServer().Register(webhooks.QuotaPath, &webhook.Admission{Handler: &webhooks.QuotaValidator{
+			Client:   mgr.GetClient(),
+			Quota:    operatorConfig.Quota,
+			Notebook: operatorConfig.Notebook,
+			Dask:     operatorConfig.Dask,
+		}})
+		mgr.GetWebhookServer().Register(webhooks.ServiceAccountPath, &webhook.Admission{Handler: &webhooks.ServiceAccountValidator{
+			Notebook: operatorConfig.Notebook,
+		}})
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -110,3 +297,129 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// render prints the objects generated for the Jupyter and Dask manifests of
+// a file without connecting to a cluster.
+func render(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	file := fs.String("f", "-", "The file holding the Jupyter and Dask manifests, - for stdin.")
+	configFile := fs.String("config", "", "The operator configuration file the objects are rendered with.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	operatorConfig := configv1alpha1.OperatorConfig{}
+	if *configFile != "" {
+		content, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return err
+		}
+		decoder := serializer.NewCodecFactory(scheme).UniversalDecoder()
+		if err = runtime.DecodeInto(decoder, content, &operatorConfig); err != nil {
+			return err
+		}
+	}
+
+	in := os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	return controllers.Render(in, os.Stdout, scheme, controllers.RenderConfig{
+		Notebook: operatorConfig.Notebook,
+		Dask:     operatorConfig.Dask,
+	})
+}
+
+// parseNetworkPolicyConfig builds the NetworkPolicy settings of isolated
+// notebooks from their command line representation.
+func parseNetworkPolicyConfig(namespaceSelector, proxySelector, cidrs string) (configv1alpha1.NetworkPolicyConfig, error) {
+	config := configv1alpha1.NetworkPolicyConfig{}
+
+	var err error
+	if namespaceSelector != "" {
+		if config.IngressNamespaceSelector, err = metav1.ParseToLabelSelector(namespaceSelector); err != nil {
+			return config, err
+		}
+	}
+	if proxySelector != "" {
+		if config.AuthProxySelector, err = metav1.ParseToLabelSelector(proxySelector); err != nil {
+			return config, err
+		}
+	}
+	config.EgressCIDRs = splitList(cidrs)
+	return config, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// watchedNamespaces returns the namespaces listed in the configuration along
+// with the ones matching its namespace selector. It returns no namespace when
+// the operator should watch the whole cluster.
+func watchedNamespaces(restConfig *rest.Config, operatorConfig configv1alpha1.OperatorConfig) ([]string, error) {
+	namespaces := append([]string{}, operatorConfig.Namespaces...)
+	if operatorConfig.NamespaceSelector == nil {
+		return namespaces, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(operatorConfig.NamespaceSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	// The manager cache doesn't exist yet, so list with a direct client
+	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	list := &corev1.NamespaceList{}
+	if err = c.List(context.Background(), list, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+
+	for _, ns := range list.Items {
+		if !containsString(namespaces, ns.Name) {
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+
+	// An empty list would widen the operator to the whole cluster
+	if len(namespaces) == 0 {
+		return nil, fmt.Errorf("no namespace matches the selector %q", selector)
+	}
+	return namespaces, nil
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNetworkPolicyConfig checks the egress CIDRs, which are otherwise
+// only rejected by the API server when creating the NetworkPolicies.
+func validateNetworkPolicyConfig(config configv1alpha1.NetworkPolicyConfig) error {
+	for _, cidr := range config.EgressCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
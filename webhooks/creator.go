@@ -0,0 +1,76 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// CreatorPath is where the CreatorAnnotator is served
+const CreatorPath = "/mutate-creator"
+
+//+kubebuilder:webhook:path=/mutate-creator,mutating=true,failurePolicy=fail,sideEffects=None,groups=operators.convect.ai,resources=jupyters;dasks,verbs=create;update,versions=v2,name=mcreator.convect.ai,admissionReviewVersions={v1,v1beta1}
+
+// CreatorAnnotator records the user creating a Jupyter or Dask in its
+// creator annotation, and keeps the annotation from changing afterwards.
+type CreatorAnnotator struct {
+	decoder *admission.Decoder
+}
+
+// InjectDecoder injects the decoder of the admission requests.
+func (a *CreatorAnnotator) InjectDecoder(d *admission.Decoder) error {
+	a.decoder = d
+	return nil
+}
+
+// Handle sets the creator annotation to the requesting user on creation,
+// and to its previous value on update.
+func (a *CreatorAnnotator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	obj := &unstructured.Unstructured{}
+	if err := a.decoder.Decode(req, obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	creator := req.UserInfo.Username
+	if req.Operation == admissionv1.Update {
+		old := &unstructured.Unstructured{}
+		if err := a.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		creator = old.GetAnnotations()[operatorsv2.CreatorAnnotation]
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations[operatorsv2.CreatorAnnotation] == creator {
+		return admission.Allowed("")
+	}
+	if creator == "" {
+		// Created before the creator was tracked, nobody can claim it since
+		delete(annotations, operatorsv2.CreatorAnnotation)
+	} else {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[operatorsv2.CreatorAnnotation] = creator
+	}
+	obj.SetAnnotations(annotations)
+
+	marshaled, err := json.Marshal(obj)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// objectCreator returns the creator of an admitted object, which the
+// CreatorAnnotator set before the validating webhooks run.
+func objectCreator(obj metav1.Object) string {
+	return obj.GetAnnotations()[operatorsv2.CreatorAnnotation]
+}
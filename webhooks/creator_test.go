@@ -0,0 +1,72 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("Creator annotator", func() {
+	scheme := runtime.NewScheme()
+	Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+
+	annotator := &CreatorAnnotator{}
+	decoder, err := admission.NewDecoder(scheme)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(annotator.InjectDecoder(decoder)).To(Succeed())
+
+	request := func(op admissionv1.Operation, user string, obj, old *operatorsv2.Jupyter) admission.Request {
+		req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: op,
+			Kind:      metav1.GroupVersionKind{Group: operatorsv2.GroupVersion.Group, Version: "v2", Kind: "Jupyter"},
+			Name:      obj.Name,
+			Namespace: obj.Namespace,
+			UserInfo:  authenticationv1.UserInfo{Username: user},
+		}}
+		req.Object.Raw, _ = json.Marshal(obj)
+		if old != nil {
+			req.OldObject.Raw, _ = json.Marshal(old)
+		}
+		return req
+	}
+
+	notebook := func(creator string) *operatorsv2.Jupyter {
+		nb := &operatorsv2.Jupyter{ObjectMeta: metav1.ObjectMeta{Name: "notebook", Namespace: "team"}}
+		if creator != "" {
+			nb.Annotations = map[string]string{operatorsv2.CreatorAnnotation: creator}
+		}
+		return nb
+	}
+
+	It("Should record the user creating the object", func() {
+		resp := annotator.Handle(context.Background(), request(admissionv1.Create, "alice@example.com", notebook(""), nil))
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Patches).To(HaveLen(1))
+		Expect(resp.Patches[0].Value).To(HaveKeyWithValue(operatorsv2.CreatorAnnotation, "alice@example.com"))
+	})
+
+	It("Should not let the creator be forged", func() {
+		resp := annotator.Handle(context.Background(), request(admissionv1.Create, "alice@example.com", notebook("bob@example.com"), nil))
+		Expect(resp.Patches).To(HaveLen(1))
+		Expect(resp.Patches[0].Value).To(Equal("alice@example.com"))
+	})
+
+	It("Should keep the creator on update", func() {
+		resp := annotator.Handle(context.Background(), request(admissionv1.Update, "bob@example.com", notebook("bob@example.com"), notebook("alice@example.com")))
+		Expect(resp.Patches).To(HaveLen(1))
+		Expect(resp.Patches[0].Value).To(Equal("alice@example.com"))
+
+		resp = annotator.Handle(context.Background(), request(admissionv1.Update, "bob@example.com", notebook("alice@example.com"), notebook("alice@example.com")))
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Patches).To(BeEmpty())
+	})
+})
@@ -0,0 +1,235 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhooks contains the admission webhooks of the operator
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+	"convect.ai/notebook-crd/controllers"
+)
+
+// QuotaPath is where the QuotaValidator is served
+const QuotaPath = "/validate-quota"
+
+//+kubebuilder:webhook:path=/validate-quota,mutating=false,failurePolicy=fail,sideEffects=None,groups=operators.convect.ai,resources=jupyters;dasks,verbs=create;update,versions=v2,name=vquota.convect.ai,admissionReviewVersions={v1,v1beta1}
+
+// QuotaValidator rejects the Jupyter and Dask objects that would make their
+// namespace, or their creator, exceed the configured quota. Unlike a ResourceQuota, which only
+// rejects the pods, the object itself is refused.
+type QuotaValidator struct {
+	// Client reads the existing objects, from the manager cache
+	Client client.Client
+	Quota  configv1alpha1.QuotaConfig
+
+	// Notebook and Dask hold the default resources of the containers that
+	// don't set theirs
+	Notebook configv1alpha1.NotebookConfig
+	Dask     configv1alpha1.DaskConfig
+
+	decoder *admission.Decoder
+}
+
+// InjectDecoder injects the decoder of the admission requests.
+func (v *QuotaValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle admits the object if the usage of its namespace, or of its creator,
+// with the object replacing its previous version, stays within the quota.
+func (v *QuotaValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Kind.Kind != "Jupyter" && req.Kind.Kind != "Dask" {
+		return admission.Allowed("")
+	}
+
+	total, creator, err := v.objectUsage(req.Kind.Kind, req.Object)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	// Never block changes that don't grow the usage, such as stopping a
+	// notebook in a namespace already over a lowered quota
+	if req.Operation == admissionv1.Update {
+		previous, _, err := v.objectUsage(req.Kind.Kind, req.OldObject)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if !total.exceeds(previous) {
+			return admission.Allowed("")
+		}
+	}
+
+	// Sum the other objects of the namespace, or of the creator anywhere
+	subject := "namespace " + req.Namespace
+	var opts []client.ListOption
+	counts := func(obj metav1.Object) bool {
+		return obj.GetNamespace() != req.Namespace || obj.GetName() != req.Name
+	}
+	if v.Quota.Scope == configv1alpha1.QuotaScopeOwner {
+		if creator == "" {
+			creator = req.UserInfo.Username
+		}
+		subject = "user " + creator
+		sameObject := counts
+		counts = func(obj metav1.Object) bool {
+			return objectCreator(obj) == creator && sameObject(obj)
+		}
+	} else {
+		opts = append(opts, client.InNamespace(req.Namespace))
+	}
+
+	notebooks := &operatorsv2.JupyterList{}
+	if err := v.Client.List(ctx, notebooks, opts...); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	for i := range notebooks.Items {
+		if req.Kind.Kind != "Jupyter" || counts(&notebooks.Items[i]) {
+			total.addJupyter(&notebooks.Items[i], v.Notebook)
+		}
+	}
+
+	clusters := &operatorsv2.DaskList{}
+	if err := v.Client.List(ctx, clusters, opts...); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	for i := range clusters.Items {
+		if req.Kind.Kind != "Dask" || counts(&clusters.Items[i]) {
+			total.addDask(&clusters.Items[i], v.Dask)
+		}
+	}
+
+	if err := total.check(v.Quota); err != nil {
+		return admission.Denied(fmt.Sprintf("%s %v", subject, err))
+	}
+	return admission.Allowed("")
+}
+
+// objectUsage returns the usage and the creator of the Jupyter or Dask in raw
+func (v *QuotaValidator) objectUsage(kind string, raw runtime.RawExtension) (usage, string, error) {
+	u := usage{}
+	if kind == "Jupyter" {
+		notebook := &operatorsv2.Jupyter{}
+		if err := v.decoder.DecodeRaw(raw, notebook); err != nil {
+			return u, "", err
+		}
+		u.addJupyter(notebook, v.Notebook)
+		return u, objectCreator(notebook), nil
+	}
+
+	dask := &operatorsv2.Dask{}
+	if err := v.decoder.DecodeRaw(raw, dask); err != nil {
+		return u, "", err
+	}
+	u.addDask(dask, v.Dask)
+	return u, objectCreator(dask), nil
+}
+
+// usage sums what a set of notebooks and Dask clusters run
+type usage struct {
+	notebooks int
+	workers   int32
+	cpu       resource.Quantity
+	memory    resource.Quantity
+}
+
+// addJupyter adds a notebook, unless it is stopped. A notebook its schedule
+// keeps stopped still counts, as the controller starts it again without
+// admission.
+func (u *usage) addJupyter(notebook *operatorsv2.Jupyter, config configv1alpha1.NotebookConfig) {
+	if _, stopped := notebook.Annotations[operatorsv2.StoppedAnnotation]; stopped {
+		return
+	}
+	u.notebooks++
+	u.addPod(&notebook.Spec.Template.Spec, config.DefaultResources, 1)
+}
+
+func (u *usage) addDask(dask *operatorsv2.Dask, config configv1alpha1.DaskConfig) {
+	u.addPod(&dask.Spec.SchedulerTemplate.Spec, config.DefaultResources, 1)
+	if _, stopped := dask.Annotations[operatorsv2.StoppedAnnotation]; stopped {
+		return
+	}
+	for _, group := range dask.EffectiveWorkerGroups() {
+		workers := int32(1)
+		if group.Replicas != nil {
+			workers = *group.Replicas
+		}
+		u.workers += workers
+		u.addPod(&group.Template.Spec, config.DefaultResources, workers)
+	}
+}
+
+// addPod adds the requests of replicas pods, with the defaults the
+// controllers give the first container, using the limits of the containers
+// that don't set requests as the API server would.
+func (u *usage) addPod(spec *corev1.PodSpec, defaults corev1.ResourceRequirements, replicas int32) {
+	containers := append([]corev1.Container{}, spec.Containers...)
+	if len(containers) > 0 {
+		controllers.ApplyContainerDefaults(&containers[0], "", defaults)
+	}
+	for _, c := range containers {
+		if cpu, ok := containerRequest(c, corev1.ResourceCPU); ok {
+			u.cpu.Add(*resource.NewMilliQuantity(cpu.MilliValue()*int64(replicas), resource.DecimalSI))
+		}
+		if memory, ok := containerRequest(c, corev1.ResourceMemory); ok {
+			u.memory.Add(*resource.NewQuantity(memory.Value()*int64(replicas), resource.BinarySI))
+		}
+	}
+}
+
+func containerRequest(c corev1.Container, name corev1.ResourceName) (resource.Quantity, bool) {
+	if q, ok := c.Resources.Requests[name]; ok {
+		return q, true
+	}
+	q, ok := c.Resources.Limits[name]
+	return q, ok
+}
+
+// exceeds reports whether u uses more of anything than other
+func (u *usage) exceeds(other usage) bool {
+	return u.notebooks > other.notebooks || u.workers > other.workers ||
+		u.cpu.Cmp(other.cpu) > 0 || u.memory.Cmp(other.memory) > 0
+}
+
+// check returns an error describing the first cap the usage exceeds
+func (u *usage) check(quota configv1alpha1.QuotaConfig) error {
+	if quota.MaxRunningNotebooks > 0 && u.notebooks > quota.MaxRunningNotebooks {
+		return fmt.Errorf("would run %d notebooks, the quota allows %d", u.notebooks, quota.MaxRunningNotebooks)
+	}
+	if quota.MaxDaskWorkers > 0 && u.workers > quota.MaxDaskWorkers {
+		return fmt.Errorf("would run %d Dask workers, the quota allows %d", u.workers, quota.MaxDaskWorkers)
+	}
+	if quota.MaxCPU != nil && u.cpu.Cmp(*quota.MaxCPU) > 0 {
+		return fmt.Errorf("would request %s CPU, the quota allows %s", u.cpu.String(), quota.MaxCPU.String())
+	}
+	if quota.MaxMemory != nil && u.memory.Cmp(*quota.MaxMemory) > 0 {
+		return fmt.Errorf("would request %s of memory, the quota allows %s", u.memory.String(), quota.MaxMemory.String())
+	}
+	return nil
+}
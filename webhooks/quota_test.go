@@ -0,0 +1,186 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("Quota validator", func() {
+	const Namespace = "team"
+
+	scheme := runtime.NewScheme()
+	Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+
+	notebook := func(name, cpu string) *operatorsv2.Jupyter {
+		return &operatorsv2.Jupyter{
+			TypeMeta:   metav1.TypeMeta{APIVersion: operatorsv2.GroupVersion.String(), Kind: "Jupyter"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: Namespace},
+			Spec: operatorsv2.JupyterSpec{
+				Template: operatorsv2.JupyterTemplate{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{
+						Name: "notebook",
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)},
+						},
+					}}},
+				},
+			},
+		}
+	}
+
+	request := func(op admissionv1.Operation, obj, old runtime.Object) admission.Request {
+		req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: op,
+			Kind:      metav1.GroupVersionKind{Group: operatorsv2.GroupVersion.Group, Version: "v2", Kind: obj.GetObjectKind().GroupVersionKind().Kind},
+			Name:      obj.(metav1.Object).GetName(),
+			Namespace: Namespace,
+		}}
+		req.Object.Raw, _ = json.Marshal(obj)
+		if old != nil {
+			req.OldObject.Raw, _ = json.Marshal(old)
+		}
+		return req
+	}
+
+	validator := func(quota configv1alpha1.QuotaConfig, existing ...runtime.Object) *QuotaValidator {
+		v := &QuotaValidator{Client: fake.NewFakeClientWithScheme(scheme, existing...), Quota: quota}
+		decoder, err := admission.NewDecoder(scheme)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v.InjectDecoder(decoder)).To(Succeed())
+		return v
+	}
+
+	It("Should reject a notebook over the running notebooks cap", func() {
+		v := validator(configv1alpha1.QuotaConfig{MaxRunningNotebooks: 1}, notebook("first", "1"))
+		resp := v.Handle(context.Background(), request(admissionv1.Create, notebook("second", "1"), nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("would run 2 notebooks"))
+	})
+
+	It("Should not count stopped notebooks", func() {
+		stopped := notebook("first", "1")
+		stopped.Annotations = map[string]string{operatorsv2.StoppedAnnotation: "2021-06-01T10:00:00Z"}
+		v := validator(configv1alpha1.QuotaConfig{MaxRunningNotebooks: 1}, stopped)
+		resp := v.Handle(context.Background(), request(admissionv1.Create, notebook("second", "1"), nil))
+		Expect(resp.Allowed).To(BeTrue())
+	})
+
+	It("Should count notebooks their schedule keeps stopped", func() {
+		scheduled := notebook("first", "1")
+		// Stopped every minute, started once a year
+		scheduled.Spec.Schedule = &operatorsv2.NotebookSchedule{Stop: "* * * * *", Start: "0 0 1 1 *"}
+		v := validator(configv1alpha1.QuotaConfig{MaxRunningNotebooks: 1}, scheduled)
+		resp := v.Handle(context.Background(), request(admissionv1.Create, notebook("second", "1"), nil))
+		Expect(resp.Allowed).To(BeFalse())
+	})
+
+	It("Should count the default requests of containers that don't set any", func() {
+		unset := notebook("first", "1")
+		unset.Spec.Template.Spec.Containers[0].Resources = corev1.ResourceRequirements{}
+		maxCPU := resource.MustParse("2")
+		v := validator(configv1alpha1.QuotaConfig{MaxCPU: &maxCPU}, unset)
+		v.Notebook.DefaultResources = corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1500m")},
+		}
+		resp := v.Handle(context.Background(), request(admissionv1.Create, notebook("second", "1"), nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("would request 2500m CPU"))
+	})
+
+	It("Should sum the CPU of notebooks and Dask workers", func() {
+		workers := int32(3)
+		dask := &operatorsv2.Dask{
+			TypeMeta:   metav1.TypeMeta{APIVersion: operatorsv2.GroupVersion.String(), Kind: "Dask"},
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: Namespace},
+			Spec: operatorsv2.DaskSpec{
+				NumWorkers: &workers,
+				WorkerTemplate: operatorsv2.WorkerTemplate{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{
+						Name: "worker",
+						Resources: corev1.ResourceRequirements{
+							Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")},
+						},
+					}}},
+				},
+			},
+		}
+		maxCPU := resource.MustParse("8")
+		v := validator(configv1alpha1.QuotaConfig{MaxCPU: &maxCPU}, notebook("first", "1500m"))
+
+		resp := v.Handle(context.Background(), request(admissionv1.Create, dask, nil))
+		Expect(resp.Allowed).To(BeTrue())
+
+		workers = 4
+		resp = v.Handle(context.Background(), request(admissionv1.Create, dask, nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("CPU"))
+	})
+
+	It("Should sum the workers of every worker group", func() {
+		highmem, spot := int32(2), int32(4)
+		dask := &operatorsv2.Dask{
+			TypeMeta:   metav1.TypeMeta{APIVersion: operatorsv2.GroupVersion.String(), Kind: "Dask"},
+			ObjectMeta: metav1.ObjectMeta{Name: "groups", Namespace: Namespace},
+			Spec: operatorsv2.DaskSpec{
+				WorkerGroups: []operatorsv2.DaskWorkerGroup{
+					{Name: "highmem", Replicas: &highmem},
+					{Name: "spot", Replicas: &spot},
+				},
+			},
+		}
+		v := validator(configv1alpha1.QuotaConfig{MaxDaskWorkers: 5})
+		resp := v.Handle(context.Background(), request(admissionv1.Create, dask, nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("would run 6 Dask workers"))
+	})
+
+	It("Should replace the previous version of an updated object", func() {
+		v := validator(configv1alpha1.QuotaConfig{MaxRunningNotebooks: 1}, notebook("first", "1"))
+		resp := v.Handle(context.Background(), request(admissionv1.Update, notebook("first", "2"), notebook("first", "1")))
+		Expect(resp.Allowed).To(BeTrue())
+	})
+
+	It("Should allow updates that don't grow the usage", func() {
+		maxCPU := resource.MustParse("1")
+		v := validator(configv1alpha1.QuotaConfig{MaxCPU: &maxCPU}, notebook("first", "4"))
+		resp := v.Handle(context.Background(), request(admissionv1.Update, notebook("first", "2"), notebook("first", "4")))
+		Expect(resp.Allowed).To(BeTrue())
+	})
+
+	It("Should sum the notebooks of the creator across namespaces", func() {
+		quota := configv1alpha1.QuotaConfig{Scope: configv1alpha1.QuotaScopeOwner, MaxRunningNotebooks: 1}
+		elsewhere := notebook("first", "1")
+		elsewhere.Namespace = "other"
+		elsewhere.Annotations = map[string]string{operatorsv2.CreatorAnnotation: "alice"}
+		colleague := notebook("colleague", "1")
+		colleague.Annotations = map[string]string{operatorsv2.CreatorAnnotation: "bob"}
+		v := validator(quota, elsewhere, colleague)
+
+		created := notebook("second", "1")
+		created.Annotations = map[string]string{operatorsv2.CreatorAnnotation: "bob"}
+		Expect(v.Handle(context.Background(), request(admissionv1.Create, created, nil)).Allowed).To(BeFalse())
+
+		created.Annotations[operatorsv2.CreatorAnnotation] = "alice"
+		resp := v.Handle(context.Background(), request(admissionv1.Create, created, nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("user alice would run 2 notebooks"))
+
+		created.Annotations[operatorsv2.CreatorAnnotation] = "carol"
+		Expect(v.Handle(context.Background(), request(admissionv1.Create, created, nil)).Allowed).To(BeTrue())
+	})
+})
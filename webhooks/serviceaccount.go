@@ -0,0 +1,86 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+// ServiceAccountPath is where the ServiceAccountValidator is served
+const ServiceAccountPath = "/validate-serviceaccount"
+
+//+kubebuilder:webhook:path=/validate-serviceaccount,mutating=false,failurePolicy=fail,sideEffects=None,groups=operators.convect.ai,resources=jupyters,verbs=create;update,versions=v2,name=vserviceaccount.convect.ai,admissionReviewVersions={v1,v1beta1}
+
+// ServiceAccountValidator rejects the notebooks asking for a ServiceAccount
+// bound to a ClusterRole the configuration doesn't allow. The controller
+// refuses them too, this only reports it to the user right away.
+type ServiceAccountValidator struct {
+	Notebook configv1alpha1.NotebookConfig
+
+	decoder *admission.Decoder
+}
+
+// InjectDecoder injects the decoder of the admission requests.
+func (v *ServiceAccountValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle admits the notebook if its ClusterRole is allowed, or didn't change
+// since a previous version, so that notebooks stay editable when an admin
+// removes their role from the configuration.
+func (v *ServiceAccountValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Kind.Kind != "Jupyter" {
+		return admission.Allowed("")
+	}
+
+	notebook := &operatorsv2.Jupyter{}
+	if err := v.decoder.DecodeRaw(req.Object, notebook); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	role := clusterRole(notebook)
+	if role == "" || v.Notebook.AllowsClusterRole(role) {
+		return admission.Allowed("")
+	}
+
+	if req.Operation == admissionv1.Update {
+		old := &operatorsv2.Jupyter{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if clusterRole(old) == role {
+			return admission.Allowed("")
+		}
+	}
+	return admission.Denied(fmt.Sprintf("ClusterRole %s isn't allowed for notebook ServiceAccounts", role))
+}
+
+// clusterRole returns the ClusterRole the notebook binds to its ServiceAccount
+func clusterRole(notebook *operatorsv2.Jupyter) string {
+	if notebook.Spec.ServiceAccount == nil {
+		return ""
+	}
+	return notebook.Spec.ServiceAccount.ClusterRole
+}
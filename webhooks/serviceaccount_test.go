@@ -0,0 +1,69 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	configv1alpha1 "convect.ai/notebook-crd/api/config/v1alpha1"
+	operatorsv2 "convect.ai/notebook-crd/api/v2"
+)
+
+var _ = Describe("ServiceAccount validator", func() {
+	scheme := runtime.NewScheme()
+	Expect(operatorsv2.AddToScheme(scheme)).To(Succeed())
+
+	validator := &ServiceAccountValidator{
+		Notebook: configv1alpha1.NotebookConfig{ServiceAccountClusterRoles: []string{"view"}},
+	}
+	decoder, err := admission.NewDecoder(scheme)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(validator.InjectDecoder(decoder)).To(Succeed())
+
+	notebook := func(role string) *operatorsv2.Jupyter {
+		nb := &operatorsv2.Jupyter{ObjectMeta: metav1.ObjectMeta{Name: "notebook", Namespace: "team"}}
+		if role != "" {
+			nb.Spec.ServiceAccount = &operatorsv2.NotebookServiceAccount{ClusterRole: role}
+		}
+		return nb
+	}
+
+	request := func(op admissionv1.Operation, obj, old *operatorsv2.Jupyter) admission.Request {
+		req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: op,
+			Kind:      metav1.GroupVersionKind{Group: operatorsv2.GroupVersion.Group, Version: "v2", Kind: "Jupyter"},
+			Name:      obj.Name,
+			Namespace: obj.Namespace,
+		}}
+		req.Object.Raw, _ = json.Marshal(obj)
+		if old != nil {
+			req.OldObject.Raw, _ = json.Marshal(old)
+		}
+		return req
+	}
+
+	It("Should admit allowed ClusterRoles and notebooks without a ServiceAccount", func() {
+		Expect(validator.Handle(context.Background(), request(admissionv1.Create, notebook("view"), nil)).Allowed).To(BeTrue())
+		Expect(validator.Handle(context.Background(), request(admissionv1.Create, notebook(""), nil)).Allowed).To(BeTrue())
+	})
+
+	It("Should reject any other ClusterRole", func() {
+		resp := validator.Handle(context.Background(), request(admissionv1.Create, notebook("cluster-admin"), nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(string(resp.Result.Reason)).To(ContainSubstring("ClusterRole cluster-admin isn't allowed"))
+
+		resp = validator.Handle(context.Background(), request(admissionv1.Update, notebook("cluster-admin"), notebook("view")))
+		Expect(resp.Allowed).To(BeFalse())
+	})
+
+	It("Should keep notebooks whose ClusterRole was disallowed since editable", func() {
+		resp := validator.Handle(context.Background(), request(admissionv1.Update, notebook("edit"), notebook("edit")))
+		Expect(resp.Allowed).To(BeTrue())
+	})
+})